@@ -4,23 +4,36 @@ Package auth provides an IP and user credentials based authentication handler.
 package auth
 
 import (
+	"bufio"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"hash"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 
+	"github.com/blueimp/aws-smtp-relay/internal/metrics"
+	"github.com/blueimp/aws-smtp-relay/internal/network"
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // Authentication implements the AuthHandler interface.
 type Authentication struct {
-	ips  map[string]bool
-	user string
-	hash []byte
-	pass []byte
-	err  error
+	allow   network.List
+	deny    network.List
+	trusted network.List
+	user    string
+	hash    []byte
+	pass    []byte
+	users   map[string][]byte
+	certs   map[string]string
+	err     error
 }
 
 func validMAC(fn func() hash.Hash, message, messageMAC, key []byte) bool {
@@ -30,6 +43,90 @@ func validMAC(fn func() hash.Hash, message, messageMAC, key []byte) bool {
 	return hmac.Equal(messageMAC, expectedMAC)
 }
 
+func (a Authentication) validateIP(ip net.IP) error {
+	if a.deny.Contains(ip) {
+		return errors.New("Denied client IP: " + ip.String())
+	}
+	if a.allow != nil && !a.allow.Contains(ip) && !a.trusted.Contains(ip) {
+		return errors.New("Invalid client IP: " + ip.String())
+	}
+	return nil
+}
+
+// HandlerConnect validates remote IPs on connection.
+func (a Authentication) HandlerConnect(remoteAddr net.Addr) bool {
+	if err := a.validateIP(session.IP(remoteAddr)); err != nil {
+		relay.Log(remoteAddr, nil, nil, err)
+		return false
+	}
+	return true
+}
+
+// Trusted reports whether the remote IP may send emails without
+// authentication.
+func (a Authentication) Trusted(remoteAddr net.Addr) bool {
+	ip := session.IP(remoteAddr)
+	return a.trusted.Contains(ip) && !a.deny.Contains(ip)
+}
+
+// Identities returns the identities of a client certificate, in the order of
+// URI, DNS and email subject alternative names, followed by the subject common
+// name.
+func Identities(cert *x509.Certificate) []string {
+	var identities []string
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	return identities
+}
+
+// certificateUser returns the user of the given client certificate.
+func (a Authentication) certificateUser(cert *x509.Certificate) (string, error) {
+	identities := Identities(cert)
+	if len(a.certs) == 0 {
+		if cert.Subject.CommonName == "" {
+			return "", errors.New("Missing client certificate common name")
+		}
+		return cert.Subject.CommonName, nil
+	}
+	for _, identity := range identities {
+		if user, ok := a.certs[identity]; ok {
+			return user, nil
+		}
+	}
+	return "", errors.New(
+		"Unknown client certificate identity: " + strings.Join(identities, ","),
+	)
+}
+
+// HandlerCertificate validates remote IPs and maps verified client
+// certificates to users.
+func (a Authentication) HandlerCertificate(
+	remoteAddr net.Addr,
+	chain []*x509.Certificate,
+) bool {
+	err := a.validateIP(session.IP(remoteAddr))
+	var name string
+	if err == nil {
+		name, err = a.certificateUser(chain[0])
+	}
+	if err != nil {
+		metrics.Auth.Inc("CERTIFICATE", "failure")
+		relay.Log(remoteAddr, nil, nil, err)
+		return false
+	}
+	metrics.Auth.Inc("CERTIFICATE", "success")
+	if addr, ok := remoteAddr.(*session.Addr); ok {
+		addr.User = name
+	}
+	return true
+}
+
 // Handler validates remote IPs and user credentials.
 func (a Authentication) Handler(
 	remoteAddr net.Addr,
@@ -37,54 +134,155 @@ func (a Authentication) Handler(
 	username []byte,
 	password []byte,
 	shared []byte,
+) (bool, error) {
+	success, err := a.authenticate(
+		remoteAddr,
+		mechanism,
+		username,
+		password,
+		shared,
+	)
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	metrics.Auth.Inc(mechanism, result)
+	return success, err
+}
+
+func (a Authentication) authenticate(
+	remoteAddr net.Addr,
+	mechanism string,
+	username []byte,
+	password []byte,
+	shared []byte,
 ) (bool, error) {
 	if a.err != nil {
 		return false, a.err
 	}
-	if a.ips != nil {
-		ip := remoteAddr.(*net.TCPAddr).IP.String()
-		if !a.ips[ip] {
-			return false, errors.New("Invalid client IP: " + ip)
+	if err := a.validateIP(session.IP(remoteAddr)); err != nil {
+		return false, err
+	}
+	if a.user == "" && a.users == nil {
+		if a.certs != nil {
+			return false, errors.New("Client certificate required")
+		}
+		// Without allowed IPs, any untrusted client could authenticate, so the
+		// attempt is logged and answered as invalid credentials:
+		if a.allow == nil && a.trusted != nil {
+			relay.Log(remoteAddr, nil, nil, errors.New(
+				"No credentials configured for untrusted client IP: "+
+					session.IP(remoteAddr).String(),
+			))
+			return false, nil
 		}
+		return true, nil
+	}
+	var success bool
+	var err error
+	name := string(username)
+	hash, ok := a.users[name]
+	switch {
+	case a.user != "" && name == a.user:
+		success, err = a.authenticateUser(mechanism, password, shared)
+	case !ok:
+		return false, errors.New("Invalid username: " + name)
+	case mechanism == "CRAM-MD5":
+		return false, errors.New("Unsupported mechanism for user: " + name)
+	default:
+		err = bcrypt.CompareHashAndPassword(hash, password)
+		success = err == nil
+	}
+	if addr, ok := remoteAddr.(*session.Addr); ok && success {
+		addr.User = name
 	}
-	if a.user != "" {
-		if string(username) != a.user {
-			return false, errors.New("Invalid username: " + string(username))
+	return success, err
+}
+
+func (a Authentication) authenticateUser(
+	mechanism string,
+	password []byte,
+	shared []byte,
+) (bool, error) {
+	if mechanism == "CRAM-MD5" {
+		messageMac := make([]byte, hex.DecodedLen(len(password)))
+		n, err := hex.Decode(messageMac, password)
+		if err != nil {
+			return false, err
+		}
+		return validMAC(md5.New, shared, messageMac[:n], a.pass), nil
+	}
+	err := bcrypt.CompareHashAndPassword(a.hash, password)
+	return err == nil, err
+}
+
+// ReadUsers reads users and their bcrypt password hashes from a file in Apache
+// htpasswd format, e.g. created via `htpasswd -B`.
+// Empty lines and lines starting with # are ignored.
+func ReadUsers(name string) (users map[string][]byte, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	users = make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Invalid user entry in line " + strconv.Itoa(line))
 		}
-		if mechanism == "CRAM-MD5" {
-			messageMac := make([]byte, hex.DecodedLen(len(password)))
-			n, err := hex.Decode(messageMac, password)
-			if err != nil {
-				return false, err
-			}
-			return validMAC(md5.New, shared, messageMac[:n], a.pass), nil
+		hash := []byte(parts[1])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, errors.New(
+				"Invalid bcrypt hash in line " + strconv.Itoa(line) + ": " + err.Error(),
+			)
 		}
-		err := bcrypt.CompareHashAndPassword(a.hash, password)
-		return err == nil, err
+		users[parts[0]] = hash
 	}
-	return true, nil
+	return users, scanner.Err()
 }
 
 // New creates a new Authentication config.
-// ips are required for IP access restriction.
+// allow and deny are optional IP networks for IP access restriction, with deny
+// taking precedence over allow.
+// trusted are optional IP networks allowed to send emails without
+// authentication, which are implicitly allowed unless denied.
 // user is required for LOGIN, PLAIN and CRAM-MD5 authentication.
 // hash (recommended) or pass is required for LOGIN and PLAIN authentication.
 // pass is required for CRAM-MD5 authentication (requires plain text password).
+// users maps additional usernames to bcrypt hashes for LOGIN and PLAIN
+// authentication.
+// certs enables client certificate authentication if not nil and maps client
+// certificate identities to usernames. If empty, the certificate subject
+// common name is used as username.
 func New(
-	ips map[string]bool,
+	allow network.List,
+	deny network.List,
+	trusted network.List,
 	user string,
 	hash []byte,
 	pass []byte,
+	users map[string][]byte,
+	certs map[string]string,
 ) Authentication {
 	var err error
 	if len(pass) > 0 && len(hash) == 0 {
 		hash, err = bcrypt.GenerateFromPassword(pass, 10)
 	}
 	return Authentication{
-		ips:  ips,
-		user: user,
-		pass: pass,
-		hash: hash,
-		err:  err,
+		allow:   allow,
+		deny:    deny,
+		trusted: trusted,
+		user:    user,
+		pass:    pass,
+		hash:    hash,
+		users:   users,
+		certs:   certs,
+		err:     err,
 	}
 }
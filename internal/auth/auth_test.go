@@ -3,10 +3,19 @@ package auth
 import (
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
 	"hash"
+	"io/ioutil"
 	"net"
+	"net/url"
+	"os"
+	"reflect"
 	"testing"
+
+	"github.com/blueimp/aws-smtp-relay/internal/network"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
 )
 
 // bcrypt hash for the string "password"
@@ -22,11 +31,11 @@ func createMAC(fn func() hash.Hash, message, key []byte) []byte {
 }
 
 func TestHandler(t *testing.T) {
-	ipMap := map[string]bool{"127.0.0.1": true, "2001:4860:0:2001::68": true}
+	allow, _ := network.ParseList("127.0.0.1,2001:4860:0:2001::68")
 	user := "username"
 	bcryptHash := []byte(sampleHash)
 	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
-	auth := New(ipMap, user, bcryptHash, nil)
+	auth := New(allow, nil, nil, user, bcryptHash, nil, nil, nil)
 	success, err := auth.Handler(
 		&origin,
 		"LOGIN",
@@ -43,13 +52,13 @@ func TestHandler(t *testing.T) {
 }
 
 func TestHandlerWithOriginIPv6(t *testing.T) {
-	ipMap := map[string]bool{"127.0.0.1": true, "2001:4860:0:2001::68": true}
+	allow, _ := network.ParseList("127.0.0.1,2001:4860:0:2001::68")
 	user := "username"
 	bcryptHash := []byte(sampleHash)
 	origin := net.TCPAddr{IP: []byte{
 		0x20, 0x01, 0x48, 0x60, 0, 0, 0x20, 0x01, 0, 0, 0, 0, 0, 0, 0x00, 0x68,
 	}}
-	auth := New(ipMap, user, bcryptHash, nil)
+	auth := New(allow, nil, nil, user, bcryptHash, nil, nil, nil)
 	success, err := auth.Handler(
 		&origin,
 		"LOGIN",
@@ -69,7 +78,7 @@ func TestHandlerWithInvalidPassword(t *testing.T) {
 	user := "username"
 	bcryptHash := []byte(sampleHash)
 	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
-	auth := New(nil, user, bcryptHash, nil)
+	auth := New(nil, nil, nil, user, bcryptHash, nil, nil, nil)
 	success, err := auth.Handler(
 		&origin,
 		"LOGIN",
@@ -89,7 +98,7 @@ func TestHandlerWithInvalidUsername(t *testing.T) {
 	user := "username"
 	bcryptHash := []byte(sampleHash)
 	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
-	auth := New(nil, user, bcryptHash, nil)
+	auth := New(nil, nil, nil, user, bcryptHash, nil, nil, nil)
 	success, err := auth.Handler(
 		&origin,
 		"LOGIN",
@@ -106,9 +115,9 @@ func TestHandlerWithInvalidUsername(t *testing.T) {
 }
 
 func TestHandlerWithNonAllowedIP(t *testing.T) {
-	ipMap := map[string]bool{"127.0.0.1": true, "2001:4860:0:2001::68": true}
+	allow, _ := network.ParseList("127.0.0.1,2001:4860:0:2001::68")
 	origin := net.TCPAddr{IP: []byte{192, 168, 0, 1}}
-	auth := New(ipMap, "", nil, nil)
+	auth := New(allow, nil, nil, "", nil, nil, nil, nil)
 	success, err := auth.Handler(
 		&origin,
 		"",
@@ -124,9 +133,79 @@ func TestHandlerWithNonAllowedIP(t *testing.T) {
 	}
 }
 
+func TestHandlerWithTrustedNetworksOnly(t *testing.T) {
+	trusted, _ := network.ParseList("192.168.0.0/24")
+	origin := net.TCPAddr{IP: []byte{10, 0, 0, 1}}
+	auth := New(nil, nil, trusted, "", nil, nil, nil, nil)
+	success, err := auth.Handler(
+		&origin,
+		"PLAIN",
+		[]byte("anyone"),
+		[]byte("anything"),
+		nil,
+	)
+	if success != false {
+		t.Errorf("Unexpected authentication success.")
+	}
+	if err != nil {
+		t.Errorf("Unexpected authentication error: %s", err)
+	}
+	allow, _ := network.ParseList("10.0.0.0/8")
+	auth = New(allow, nil, trusted, "", nil, nil, nil, nil)
+	success, _ = auth.Handler(&origin, "PLAIN", nil, nil, nil)
+	if success != true {
+		t.Errorf("Unexpected IP authentication failure.")
+	}
+}
+
+func TestHandlerWithCIDR(t *testing.T) {
+	allow, _ := network.ParseList("10.0.0.0/16,fd00::/8")
+	auth := New(allow, nil, nil, "", nil, nil, nil, nil)
+	for _, ip := range []string{"10.0.1.2", "fd00:0:0::0001"} {
+		origin := net.TCPAddr{IP: net.ParseIP(ip)}
+		success, err := auth.Handler(&origin, "", nil, nil, nil)
+		if success != true {
+			t.Errorf("Unexpected IP authentication failure for %s.", ip)
+		}
+		if err != nil {
+			t.Errorf("Unexpected IP authentication error for %s.", ip)
+		}
+	}
+	origin := net.TCPAddr{IP: net.ParseIP("10.1.0.1")}
+	success, err := auth.Handler(&origin, "", nil, nil, nil)
+	if success != false {
+		t.Errorf("Unexpected IP authentication success.")
+	}
+	if err == nil {
+		t.Errorf("Unexpected missing IP authentication error.")
+	}
+}
+
+func TestHandlerWithDeniedIP(t *testing.T) {
+	allow, _ := network.ParseList("10.0.0.0/16")
+	deny, _ := network.ParseList("10.0.1.0/24")
+	origin := net.TCPAddr{IP: []byte{10, 0, 1, 2}}
+	auth := New(allow, deny, nil, "", nil, nil, nil, nil)
+	success, err := auth.Handler(&origin, "", nil, nil, nil)
+	if success != false {
+		t.Errorf("Unexpected denied IP authentication success.")
+	}
+	if err == nil {
+		t.Errorf("Unexpected missing denied IP authentication error.")
+	}
+	origin = net.TCPAddr{IP: []byte{10, 0, 2, 1}}
+	success, err = auth.Handler(&origin, "", nil, nil, nil)
+	if success != true {
+		t.Errorf("Unexpected IP authentication failure.")
+	}
+	if err != nil {
+		t.Errorf("Unexpected IP authentication error.")
+	}
+}
+
 func TestHandlerWithAuthenticationDisabled(t *testing.T) {
 	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
-	auth := New(nil, "", nil, nil)
+	auth := New(nil, nil, nil, "", nil, nil, nil, nil)
 	success, err := auth.Handler(
 		&origin,
 		"",
@@ -146,7 +225,7 @@ func TestHandlerWithPasswordConfig(t *testing.T) {
 	user := "username"
 	password := []byte("password")
 	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
-	auth := New(nil, user, nil, password)
+	auth := New(nil, nil, nil, user, nil, password, nil, nil)
 	success, err := auth.Handler(
 		&origin,
 		"LOGIN",
@@ -163,11 +242,11 @@ func TestHandlerWithPasswordConfig(t *testing.T) {
 }
 
 func TestHandlerWithPLAIN(t *testing.T) {
-	ipMap := map[string]bool{"127.0.0.1": true, "2001:4860:0:2001::68": true}
+	allow, _ := network.ParseList("127.0.0.1,2001:4860:0:2001::68")
 	user := "username"
 	bcryptHash := []byte(sampleHash)
 	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
-	auth := New(ipMap, user, bcryptHash, nil)
+	auth := New(allow, nil, nil, user, bcryptHash, nil, nil, nil)
 	success, err := auth.Handler(
 		&origin,
 		"PLAIN",
@@ -187,7 +266,7 @@ func TestHandlerWithCRAMMD5(t *testing.T) {
 	user := "username"
 	password := []byte("password")
 	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
-	auth := New(nil, user, nil, password)
+	auth := New(nil, nil, nil, user, nil, password, nil, nil)
 	shared := []byte("shared")
 	success, err := auth.Handler(
 		&origin,
@@ -207,7 +286,7 @@ func TestHandlerWithCRAMMD5(t *testing.T) {
 func TestHandlerWithEmptyPasswordAndCRAMMD5(t *testing.T) {
 	user := "username"
 	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
-	auth := New(nil, user, nil, nil)
+	auth := New(nil, nil, nil, user, nil, nil, nil, nil)
 	shared := []byte("shared")
 	success, err := auth.Handler(
 		&origin,
@@ -223,3 +302,271 @@ func TestHandlerWithEmptyPasswordAndCRAMMD5(t *testing.T) {
 		t.Errorf("Unexpected password authentication error.")
 	}
 }
+
+func TestHandlerWithUsers(t *testing.T) {
+	users := map[string][]byte{"alice": []byte(sampleHash)}
+	origin := session.Addr{TCPAddr: net.TCPAddr{IP: []byte{127, 0, 0, 1}}}
+	auth := New(nil, nil, nil, "", nil, nil, users, nil)
+	success, err := auth.Handler(
+		&origin,
+		"LOGIN",
+		[]byte("alice"),
+		[]byte("password"),
+		nil,
+	)
+	if success != true {
+		t.Errorf("Unexpected authentication failure.")
+	}
+	if err != nil {
+		t.Errorf("Unexpected authentication error.")
+	}
+	if origin.User != "alice" {
+		t.Errorf("Unexpected session user: %s. Expected: %s", origin.User, "alice")
+	}
+}
+
+func TestHandlerWithUsersAndInvalidPassword(t *testing.T) {
+	users := map[string][]byte{"alice": []byte(sampleHash)}
+	origin := session.Addr{TCPAddr: net.TCPAddr{IP: []byte{127, 0, 0, 1}}}
+	auth := New(nil, nil, nil, "", nil, nil, users, nil)
+	success, err := auth.Handler(
+		&origin,
+		"PLAIN",
+		[]byte("alice"),
+		[]byte("invalid"),
+		nil,
+	)
+	if success != false {
+		t.Errorf("Unexpected password authentication success.")
+	}
+	if err == nil {
+		t.Errorf("Unexpected missing password authentication error.")
+	}
+	if origin.User != "" {
+		t.Errorf("Unexpected session user: %s", origin.User)
+	}
+}
+
+func TestHandlerWithUsersAndInvalidUsername(t *testing.T) {
+	users := map[string][]byte{"alice": []byte(sampleHash)}
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	auth := New(nil, nil, nil, "", nil, nil, users, nil)
+	success, err := auth.Handler(
+		&origin,
+		"LOGIN",
+		[]byte("bob"),
+		[]byte("password"),
+		nil,
+	)
+	if success != false {
+		t.Errorf("Unexpected username authentication success.")
+	}
+	if err == nil {
+		t.Errorf("Unexpected missing username authentication error.")
+	}
+}
+
+func TestHandlerWithUsersAndCRAMMD5(t *testing.T) {
+	users := map[string][]byte{"alice": []byte(sampleHash)}
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	auth := New(nil, nil, nil, "", nil, nil, users, nil)
+	shared := []byte("shared")
+	success, err := auth.Handler(
+		&origin,
+		"CRAM-MD5",
+		[]byte("alice"),
+		createMAC(md5.New, shared, []byte("password")),
+		shared,
+	)
+	if success != false {
+		t.Errorf("Unexpected CRAM-MD5 authentication success.")
+	}
+	if err == nil {
+		t.Errorf("Unexpected missing CRAM-MD5 authentication error.")
+	}
+}
+
+func TestHandlerWithUserAndUsers(t *testing.T) {
+	users := map[string][]byte{"alice": []byte(sampleHash)}
+	password := []byte("password")
+	origin := session.Addr{TCPAddr: net.TCPAddr{IP: []byte{127, 0, 0, 1}}}
+	auth := New(nil, nil, nil, "username", nil, password, users, nil)
+	shared := []byte("shared")
+	success, err := auth.Handler(
+		&origin,
+		"CRAM-MD5",
+		[]byte("username"),
+		createMAC(md5.New, shared, password),
+		shared,
+	)
+	if success != true {
+		t.Errorf("Unexpected authentication failure.")
+	}
+	if err != nil {
+		t.Errorf("Unexpected authentication error.")
+	}
+	if origin.User != "username" {
+		t.Errorf("Unexpected session user: %s. Expected: %s", origin.User, "username")
+	}
+}
+
+func TestReadUsers(t *testing.T) {
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("Unexpected temp file creation error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# comment\n\nalice:" + sampleHash + "\nbob:" + sampleHash + "\n")
+	file.Close()
+	users, err := ReadUsers(file.Name())
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if len(users) != 2 {
+		t.Errorf("Unexpected number of users: %d. Expected: %d", len(users), 2)
+	}
+	if string(users["alice"]) != sampleHash {
+		t.Errorf("Unexpected hash: %s. Expected: %s", users["alice"], sampleHash)
+	}
+}
+
+func TestReadUsersWithInvalidHash(t *testing.T) {
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("Unexpected temp file creation error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("alice:$apr1$salt$hash\n")
+	file.Close()
+	_, err = ReadUsers(file.Name())
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestReadUsersWithInvalidEntry(t *testing.T) {
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("Unexpected temp file creation error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("alice\n")
+	file.Close()
+	_, err = ReadUsers(file.Name())
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestHandlerConnect(t *testing.T) {
+	allow, _ := network.ParseList("10.0.0.0/16")
+	deny, _ := network.ParseList("10.0.1.0/24")
+	trusted, _ := network.ParseList("192.168.0.0/24")
+	auth := New(allow, deny, trusted, "", nil, nil, nil, nil)
+	tests := map[string]bool{
+		"10.0.2.1":    true,
+		"10.0.1.2":    false,
+		"10.1.0.1":    false,
+		"192.168.0.1": true,
+	}
+	originalOut := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() {
+		os.Stdout = originalOut
+	}()
+	for ip, expected := range tests {
+		origin := net.TCPAddr{IP: net.ParseIP(ip)}
+		if auth.HandlerConnect(&origin) != expected {
+			t.Errorf("Unexpected connect result for %s. Expected: %t", ip, expected)
+		}
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	deny, _ := network.ParseList("192.168.0.1")
+	trusted, _ := network.ParseList("192.168.0.0/24,fd00::/8")
+	auth := New(nil, deny, trusted, "username", []byte(sampleHash), nil, nil, nil)
+	tests := map[string]bool{
+		"192.168.0.2": true,
+		"192.168.0.1": false,
+		"192.168.1.1": false,
+		"fd00::1":     true,
+	}
+	for ip, expected := range tests {
+		origin := net.TCPAddr{IP: net.ParseIP(ip)}
+		if auth.Trusted(&origin) != expected {
+			t.Errorf("Unexpected trusted result for %s. Expected: %t", ip, expected)
+		}
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.org/billing")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "billing"},
+		URIs:           []*url.URL{uri},
+		DNSNames:       []string{"billing.example.org"},
+		EmailAddresses: []string{"billing@example.org"},
+	}
+	identities := Identities(cert)
+	expected := []string{
+		"spiffe://example.org/billing",
+		"billing.example.org",
+		"billing@example.org",
+		"billing",
+	}
+	if !reflect.DeepEqual(identities, expected) {
+		t.Errorf("Unexpected identities: %v. Expected: %v", identities, expected)
+	}
+}
+
+func TestHandlerCertificate(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.org/billing")
+	spiffeCert := &x509.Certificate{URIs: []*url.URL{uri}}
+	namedCert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+	deny, _ := network.ParseList("10.0.1.0/24")
+	originalOut := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() {
+		os.Stdout = originalOut
+	}()
+	auth := New(nil, deny, nil, "", nil, nil, nil, map[string]string{
+		"spiffe://example.org/billing": "billing",
+	})
+	origin := &session.Addr{TCPAddr: net.TCPAddr{IP: net.ParseIP("10.0.2.1")}}
+	if !auth.HandlerCertificate(origin, []*x509.Certificate{spiffeCert}) {
+		t.Error("Unexpected certificate rejection")
+	}
+	if origin.User != "billing" {
+		t.Errorf("Unexpected user: %s. Expected: %s", origin.User, "billing")
+	}
+	if auth.HandlerCertificate(origin, []*x509.Certificate{namedCert}) {
+		t.Error("Unexpected acceptance of unknown certificate identity")
+	}
+	denied := &net.TCPAddr{IP: net.ParseIP("10.0.1.1")}
+	if auth.HandlerCertificate(denied, []*x509.Certificate{spiffeCert}) {
+		t.Error("Unexpected acceptance of denied client IP")
+	}
+	auth = New(nil, nil, nil, "", nil, nil, nil, map[string]string{})
+	origin = &session.Addr{}
+	if !auth.HandlerCertificate(origin, []*x509.Certificate{namedCert}) {
+		t.Error("Unexpected certificate rejection")
+	}
+	if origin.User != "alice" {
+		t.Errorf("Unexpected user: %s. Expected: %s", origin.User, "alice")
+	}
+	if auth.HandlerCertificate(origin, []*x509.Certificate{spiffeCert}) {
+		t.Error("Unexpected acceptance of certificate without common name")
+	}
+}
+
+func TestHandlerWithCertificatesOnly(t *testing.T) {
+	auth := New(nil, nil, nil, "", nil, nil, nil, map[string]string{})
+	success, err := auth.Handler(&net.TCPAddr{}, "PLAIN", nil, nil, nil)
+	if success != false {
+		t.Errorf("Unexpected success: %t. Expected: %t", success, false)
+	}
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Package certificate provides a TLS certificate, which is reloaded from disk when
+the certificate or key file changes.
+*/
+package certificate
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blueimp/aws-smtp-relay/internal/pkcs"
+)
+
+// checkInterval is the minimum duration between checks for file changes.
+var checkInterval = 10 * time.Second
+
+// Reloader holds a TLS certificate loaded from a certificate and key file.
+type Reloader struct {
+	certFile   string
+	keyFile    string
+	passphrase string
+	mu         sync.Mutex
+	cert       *tls.Certificate
+	modTime    time.Time
+	checked    time.Time
+}
+
+// privateKey returns the PEM encoded private key of the given key file,
+// decrypting it with the given passphrase if it is encrypted.
+// Legacy encrypted keys with a DEK-Info header as well as PKCS#8 encrypted keys
+// ("ENCRYPTED PRIVATE KEY") are supported.
+func privateKey(keyPEMBlock []byte, passphrase string) ([]byte, error) {
+	rest := keyPEMBlock
+	for {
+		var keyDERBlock *pem.Block
+		keyDERBlock, rest = pem.Decode(rest)
+		if keyDERBlock == nil {
+			return nil, errors.New("Failed to find key PEM block")
+		}
+		switch {
+		case keyDERBlock.Type == "ENCRYPTED PRIVATE KEY":
+			key, err := pkcs.DecryptPrivateKey(keyDERBlock.Bytes, passphrase)
+			if err != nil {
+				return nil, err
+			}
+			keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			return pem.EncodeToMemory(&pem.Block{
+				Type:  "PRIVATE KEY",
+				Bytes: keyDER,
+			}), nil
+		case !strings.HasSuffix(keyDERBlock.Type, "PRIVATE KEY"):
+			continue
+		case x509.IsEncryptedPEMBlock(keyDERBlock):
+			keyDER, err := x509.DecryptPEMBlock(keyDERBlock, []byte(passphrase))
+			if err != nil {
+				return nil, err
+			}
+			return pem.EncodeToMemory(&pem.Block{
+				Type:  keyDERBlock.Type,
+				Bytes: keyDER,
+			}), nil
+		}
+		return pem.EncodeToMemory(keyDERBlock), nil
+	}
+}
+
+// bundle returns the certificate chain and private key of the given PKCS#12
+// bundle, with the certificate matching the private key first.
+func bundle(data []byte, passphrase string) (*tls.Certificate, error) {
+	key, certs, err := pkcs.DecodeBundle(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported PKCS#12 private key type")
+	}
+	cert := &tls.Certificate{PrivateKey: key}
+	for _, c := range certs {
+		if c.PublicKey != nil && cert.Leaf == nil &&
+			publicKeyEqual(c.PublicKey, signer.Public()) {
+			cert.Leaf = c
+			cert.Certificate = append([][]byte{c.Raw}, cert.Certificate...)
+			continue
+		}
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	if cert.Leaf == nil {
+		return nil, errors.New("PKCS#12 bundle contains no certificate for its key")
+	}
+	return cert, nil
+}
+
+// publicKeyEqual reports whether the given public keys are equal, by comparing
+// their PKIX encodings, as the Equal methods of the keys require Go 1.15.
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	aDER, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bDER, err := x509.MarshalPKIXPublicKey(b)
+	return err == nil && bytes.Equal(aDER, bDER)
+}
+
+// load reads the certificate and key file, decrypting the key with the given
+// passphrase if it is encrypted.
+// If the key file is not PEM encoded, it is decoded as PKCS#12 bundle and the
+// certificate file is optional.
+func load(certFile, keyFile, passphrase string) (*tls.Certificate, error) {
+	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(keyPEMBlock); block == nil {
+		return bundle(keyPEMBlock, passphrase)
+	}
+	if certFile == "" {
+		return nil, errors.New("Missing TLS cert file")
+	}
+	certPEMBlock, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEMBlock, err = privateKey(keyPEMBlock, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// modTime returns the latest modification time of the given files.
+func modTime(names ...string) (t time.Time, err error) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return t, err
+		}
+		if info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return
+}
+
+// reload loads the certificate again if the files changed since the last load.
+// Errors are logged and the previous certificate is kept, so a partially
+// written certificate and key pair is retried on the next check.
+func (r *Reloader) reload() {
+	t, err := modTime(r.certFile, r.keyFile)
+	if err == nil && t.Equal(r.modTime) {
+		return
+	}
+	var cert *tls.Certificate
+	if err == nil {
+		cert, err = load(r.certFile, r.keyFile, r.passphrase)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "TLS certificate reload: "+err.Error())
+		return
+	}
+	r.cert = cert
+	r.modTime = t
+}
+
+// GetCertificate returns the current certificate, implementing the
+// tls.Config.GetCertificate callback.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= checkInterval {
+		r.checked = now
+		r.reload()
+	}
+	return r.cert, nil
+}
+
+// New loads the given certificate and key file and returns a Reloader, which
+// reloads them when they change.
+// The key file can also be a PKCS#12 bundle, in which case certFile may be
+// empty.
+// passphrase is optional and decrypts a passphrase-protected key file.
+func New(certFile, keyFile, passphrase string) (*Reloader, error) {
+	t, err := modTime(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := load(certFile, keyFile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &Reloader{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		passphrase: passphrase,
+		cert:       cert,
+		modTime:    t,
+		checked:    time.Now(),
+	}, nil
+}
@@ -0,0 +1,222 @@
+/*
+Package config provides a YAML configuration file, which sets command-line flags
+and environment variables and holds structured settings.
+*/
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/blueimp/aws-smtp-relay/internal/policy"
+	"gopkg.in/yaml.v3"
+)
+
+// Policies holds the policy configs of users and IPs or CIDR ranges.
+type Policies struct {
+	Users map[string]policy.Config `yaml:"users"`
+	IPs   map[string]policy.Config `yaml:"ips"`
+}
+
+// Listener holds the settings of an additional SMTP listener.
+type Listener struct {
+	Listen   string `yaml:"listen"`
+	StartTLS bool   `yaml:"startTLS"`
+	OnlyTLS  bool   `yaml:"onlyTLS"`
+	// RequireAuth overrides the authentication requirement if not nil.
+	RequireAuth *bool `yaml:"requireAuth"`
+	// Policies replace the global policies if not nil.
+	Policies *Policies `yaml:"policies"`
+}
+
+// Route holds the conditions and relay settings of a routing rule.
+type Route struct {
+	SenderDomain    string            `yaml:"senderDomain"`
+	User            string            `yaml:"user"`
+	RecipientDomain string            `yaml:"recipientDomain"`
+	Headers         map[string]string `yaml:"headers"`
+	// RelayAPI overrides the relay API if not empty.
+	RelayAPI string `yaml:"relayAPI"`
+	// Region overrides the AWS region if not empty.
+	Region string `yaml:"region"`
+	// Endpoint overrides the AWS API endpoint URL if not empty.
+	Endpoint string `yaml:"endpoint"`
+	// MaxRetries overrides the maximum number of API request retries if not nil.
+	MaxRetries *int `yaml:"maxRetries"`
+	// ConfigurationSet overrides the configuration set if not nil.
+	ConfigurationSet *string `yaml:"configurationSet"`
+	// RoleArn is the ARN of an IAM role to assume, if not empty.
+	RoleArn string `yaml:"roleArn"`
+	// ExternalID is the external ID passed when assuming the IAM role.
+	ExternalID string `yaml:"externalId"`
+}
+
+type document struct {
+	Policies  *Policies            `yaml:"policies"`
+	Listeners []Listener           `yaml:"listeners"`
+	Routes    []Route              `yaml:"routes"`
+	Options   map[string]yaml.Node `yaml:",inline"`
+}
+
+type option struct {
+	key   string
+	value string
+	line  int
+}
+
+// File holds the settings of a configuration file.
+type File struct {
+	// Policies holds the structured policies settings, nil if not configured.
+	Policies *Policies
+	// Listeners holds the settings of additional SMTP listeners.
+	Listeners []Listener
+	// Routes holds the routing rules, in order of precedence.
+	Routes  []Route
+	options []option
+	flags   map[string]string
+	env     map[string]string
+}
+
+// value converts the given node to a flag value.
+// Sequences are joined as comma-separated list, mappings as comma-separated
+// name=value pairs.
+func value(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("expected a list of values")
+			}
+			values = append(values, item.Value)
+		}
+		return strings.Join(values, ","), nil
+	case yaml.MappingNode:
+		pairs := make([]string, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Kind != yaml.ScalarNode {
+				return "", errors.New("expected a mapping of values")
+			}
+			pairs = append(pairs, node.Content[i].Value+"="+node.Content[i+1].Value)
+		}
+		return strings.Join(pairs, ","), nil
+	}
+	return "", errors.New("unsupported value")
+}
+
+// Parse parses YAML configuration data.
+// flags maps configuration keys to flag names, env maps configuration keys to
+// environment variable names.
+func Parse(data []byte, flags, env map[string]string) (*File, error) {
+	var doc document
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&doc); err != nil && err != io.EOF {
+		return nil, err
+	}
+	f := &File{
+		Policies:  doc.Policies,
+		Listeners: doc.Listeners,
+		Routes:    doc.Routes,
+		flags:     flags,
+		env:       env,
+	}
+	for i, l := range f.Listeners {
+		if l.Listen == "" {
+			return nil, fmt.Errorf("listeners[%d]: missing listen address", i)
+		}
+	}
+	for i, r := range f.Routes {
+		if r.ExternalID != "" && r.RoleArn == "" {
+			return nil, fmt.Errorf("routes[%d]: externalId requires roleArn", i)
+		}
+	}
+	keys := make([]string, 0, len(doc.Options))
+	for key := range doc.Options {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return doc.Options[keys[i]].Line < doc.Options[keys[j]].Line
+	})
+	for _, key := range keys {
+		node := doc.Options[key]
+		_, isFlag := flags[key]
+		_, isEnv := env[key]
+		if !isFlag && !isEnv {
+			return nil, fmt.Errorf("line %d: unknown key %q", node.Line, key)
+		}
+		v, err := value(&node)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: key %q: %s", node.Line, key, err)
+		}
+		f.options = append(f.options, option{key: key, value: v, line: node.Line})
+	}
+	return f, nil
+}
+
+// Read reads and parses a YAML configuration file.
+func Read(name string, flags, env map[string]string) (*File, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, flags, env)
+}
+
+// Overrides returns the names of the flags set on the command-line of the given
+// flag set and of the given environment variables which are currently set.
+// Call it once before applying a configuration file for the first time.
+func Overrides(fs *flag.FlagSet, env map[string]string) map[string]bool {
+	overrides := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		overrides[fl.Name] = true
+	})
+	for _, name := range env {
+		if _, exists := os.LookupEnv(name); exists {
+			overrides[name] = true
+		}
+	}
+	return overrides
+}
+
+// Apply sets the flags of the given flag set and the environment variables,
+// which are not contained in the given overrides.
+// Flags and environment variables missing from the file are reset to their
+// defaults, so a file can be applied again after it changed.
+func (f *File) Apply(fs *flag.FlagSet, overrides map[string]bool) error {
+	for _, name := range f.env {
+		if !overrides[name] {
+			os.Unsetenv(name)
+		}
+	}
+	for _, name := range f.flags {
+		if fl := fs.Lookup(name); fl != nil && !overrides[name] {
+			fs.Set(name, fl.DefValue)
+		}
+	}
+	for _, o := range f.options {
+		if name, ok := f.env[o.key]; ok {
+			if !overrides[name] {
+				os.Setenv(name, o.value)
+			}
+			continue
+		}
+		name := f.flags[o.key]
+		if overrides[name] {
+			continue
+		}
+		if err := fs.Set(name, o.value); err != nil {
+			return fmt.Errorf("line %d: key %q: %s", o.line, o.key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testFlags = map[string]string{
+	"listen":    "a",
+	"allowIPs":  "i",
+	"emailTags": "g",
+	"startTLS":  "s",
+	"spoolAge":  "Q",
+}
+
+var testEnv = map[string]string{
+	"password": "TEST_CONFIG_PASSWORD",
+}
+
+func flagSetHelper() (
+	fs *flag.FlagSet,
+	addr *string,
+	ips *string,
+	tags *string,
+	startTLS *bool,
+	spoolAge *time.Duration,
+) {
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	addr = fs.String("a", ":1025", "")
+	ips = fs.String("i", "", "")
+	tags = fs.String("g", "", "")
+	startTLS = fs.Bool("s", false, "")
+	spoolAge = fs.Duration("Q", 24*time.Hour, "")
+	return
+}
+
+func TestApply(t *testing.T) {
+	f, err := Parse([]byte(`
+listen: ":25"
+allowIPs:
+  - 127.0.0.1
+  - 10.0.0.0/16
+emailTags:
+  a: b
+startTLS: true
+spoolAge: 1h
+password: secret
+policies:
+  users:
+    alice:
+      allowFrom: ^alice@
+      maxRecipients: 10
+  ips:
+    10.0.0.0/8:
+      denyTo: ^admin@
+`), testFlags, testEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	fs, addr, ips, tags, startTLS, spoolAge := flagSetHelper()
+	fs.Parse([]string{"-a", ":587"})
+	os.Unsetenv("TEST_CONFIG_PASSWORD")
+	defer os.Unsetenv("TEST_CONFIG_PASSWORD")
+	if err := f.Apply(fs, Overrides(fs, testEnv)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *addr != ":587" {
+		t.Errorf("Unexpected address: %s. Expected: %s", *addr, ":587")
+	}
+	if *ips != "127.0.0.1,10.0.0.0/16" {
+		t.Errorf("Unexpected IPs: %s", *ips)
+	}
+	if *tags != "a=b" {
+		t.Errorf("Unexpected email tags: %s", *tags)
+	}
+	if *startTLS != true {
+		t.Errorf("Unexpected startTLS: %t", *startTLS)
+	}
+	if *spoolAge != time.Hour {
+		t.Errorf("Unexpected spool age: %s", *spoolAge)
+	}
+	if os.Getenv("TEST_CONFIG_PASSWORD") != "secret" {
+		t.Errorf("Unexpected password: %s", os.Getenv("TEST_CONFIG_PASSWORD"))
+	}
+	if f.Policies == nil || f.Policies.Users["alice"].MaxRecipients != 10 {
+		t.Errorf("Unexpected policies: %v", f.Policies)
+	}
+	if f.Policies.IPs["10.0.0.0/8"].DenyTo != "^admin@" {
+		t.Errorf("Unexpected IP policies: %v", f.Policies.IPs)
+	}
+}
+
+func TestApplyWithExistingEnv(t *testing.T) {
+	f, err := Parse([]byte("password: secret\n"), testFlags, testEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	os.Setenv("TEST_CONFIG_PASSWORD", "env")
+	defer os.Unsetenv("TEST_CONFIG_PASSWORD")
+	fs, _, _, _, _, _ := flagSetHelper()
+	if err := f.Apply(fs, Overrides(fs, testEnv)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if os.Getenv("TEST_CONFIG_PASSWORD") != "env" {
+		t.Errorf("Unexpected password: %s", os.Getenv("TEST_CONFIG_PASSWORD"))
+	}
+}
+
+func TestApplyWithChangedFile(t *testing.T) {
+	fs, addr, ips, _, _, spoolAge := flagSetHelper()
+	fs.Parse([]string{"-a", ":587"})
+	os.Unsetenv("TEST_CONFIG_PASSWORD")
+	defer os.Unsetenv("TEST_CONFIG_PASSWORD")
+	overrides := Overrides(fs, testEnv)
+	f, err := Parse([]byte(`
+listen: ":25"
+allowIPs: 127.0.0.1
+spoolAge: 1h
+password: secret
+`), testFlags, testEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := f.Apply(fs, overrides); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	f, err = Parse([]byte("allowIPs: 10.0.0.0/8\n"), testFlags, testEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := f.Apply(fs, overrides); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *addr != ":587" {
+		t.Errorf("Unexpected address: %s. Expected: %s", *addr, ":587")
+	}
+	if *ips != "10.0.0.0/8" {
+		t.Errorf("Unexpected IPs: %s. Expected: %s", *ips, "10.0.0.0/8")
+	}
+	if *spoolAge != 24*time.Hour {
+		t.Errorf("Unexpected spool age: %s. Expected: %s", *spoolAge, 24*time.Hour)
+	}
+	if _, exists := os.LookupEnv("TEST_CONFIG_PASSWORD"); exists {
+		t.Error("Unexpected password environment variable")
+	}
+}
+
+func TestApplyWithInvalidValue(t *testing.T) {
+	f, err := Parse([]byte("listen: \":25\"\nspoolAge: invalid\n"), testFlags, testEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	fs, _, _, _, _, _ := flagSetHelper()
+	err = f.Apply(fs, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), `line 2: key "spoolAge": `) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestParseWithEmptyData(t *testing.T) {
+	f, err := Parse([]byte(""), testFlags, testEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if f.Policies != nil {
+		t.Errorf("Unexpected policies: %v", f.Policies)
+	}
+}
+
+func TestParseWithUnknownKey(t *testing.T) {
+	_, err := Parse([]byte("listen: \":25\"\nlisten2: \":26\"\n"), testFlags, testEnv)
+	if err == nil || err.Error() != `line 2: unknown key "listen2"` {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestParseWithUnknownPolicyKey(t *testing.T) {
+	_, err := Parse([]byte(`
+policies:
+  users:
+    alice:
+      allowFro: ^alice@
+`), testFlags, testEnv)
+	if err == nil || !strings.Contains(err.Error(), "line 5") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestParseWithListeners(t *testing.T) {
+	f, err := Parse([]byte(`
+listeners:
+  - listen: ":465"
+    onlyTLS: true
+  - listen: ":587"
+    startTLS: true
+    requireAuth: true
+    policies:
+      users:
+        alice:
+          maxRecipients: 1
+`), testFlags, testEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(f.Listeners) != 2 {
+		t.Fatalf("Unexpected listeners: %v", f.Listeners)
+	}
+	if f.Listeners[0].Listen != ":465" || !f.Listeners[0].OnlyTLS ||
+		f.Listeners[0].RequireAuth != nil || f.Listeners[0].Policies != nil {
+		t.Errorf("Unexpected first listener: %+v", f.Listeners[0])
+	}
+	second := f.Listeners[1]
+	if !second.StartTLS || second.RequireAuth == nil || !*second.RequireAuth {
+		t.Errorf("Unexpected second listener: %+v", second)
+	}
+	if second.Policies == nil || second.Policies.Users["alice"].MaxRecipients != 1 {
+		t.Errorf("Unexpected second listener policies: %v", second.Policies)
+	}
+}
+
+func TestParseWithInvalidListener(t *testing.T) {
+	_, err := Parse([]byte("listeners:\n  - startTLS: true\n"), testFlags, testEnv)
+	if err == nil || err.Error() != "listeners[0]: missing listen address" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestParseWithRoutes(t *testing.T) {
+	f, err := Parse([]byte(`
+routes:
+  - senderDomain: example.org
+    relayAPI: pinpoint
+    region: eu-west-1
+    endpoint: http://localhost:4566
+    maxRetries: 0
+  - headers:
+      X-Route: bulk
+    configurationSet: ""
+    roleArn: arn:aws:iam::123456789012:role/relay
+    externalId: tenant
+`), testFlags, testEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(f.Routes) != 2 {
+		t.Fatalf("Unexpected routes: %v", f.Routes)
+	}
+	first := f.Routes[0]
+	if first.SenderDomain != "example.org" || first.RelayAPI != "pinpoint" ||
+		first.Region != "eu-west-1" || first.Endpoint != "http://localhost:4566" ||
+		first.MaxRetries == nil || *first.MaxRetries != 0 ||
+		first.ConfigurationSet != nil {
+		t.Errorf("Unexpected first route: %+v", first)
+	}
+	second := f.Routes[1]
+	if second.Headers["X-Route"] != "bulk" || second.ConfigurationSet == nil ||
+		*second.ConfigurationSet != "" ||
+		second.RoleArn != "arn:aws:iam::123456789012:role/relay" ||
+		second.ExternalID != "tenant" || second.MaxRetries != nil {
+		t.Errorf("Unexpected second route: %+v", second)
+	}
+}
+
+func TestParseWithInvalidRoute(t *testing.T) {
+	_, err := Parse([]byte("routes:\n  - externalId: tenant\n"), testFlags, testEnv)
+	if err == nil || err.Error() != "routes[0]: externalId requires roleArn" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestParseWithInvalidValue(t *testing.T) {
+	_, err := Parse([]byte("allowIPs:\n  - [127.0.0.1]\n"), testFlags, testEnv)
+	if err == nil || !strings.HasPrefix(err.Error(), `line 2: key "allowIPs": `) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRead(t *testing.T) {
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("Unexpected temp file creation error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"listen": ":25"}`)
+	file.Close()
+	f, err := Read(file.Name(), testFlags, testEnv)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(f.options) != 1 || f.options[0].value != ":25" {
+		t.Errorf("Unexpected options: %v", f.options)
+	}
+	_, err = Read("/nonexistent/config.yml", testFlags, testEnv)
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
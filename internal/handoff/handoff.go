@@ -0,0 +1,134 @@
+/*
+Package handoff provides a listener which hands off accepted connections to
+consecutive views, so a server can be replaced without closing the listener.
+*/
+package handoff
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by Accept of a closed view.
+var ErrClosed = errors.New("handoff: listener view closed")
+
+// Listener accepts connections from an underlying listener and passes them on
+// to whichever view is accepting.
+type Listener struct {
+	ln       net.Listener
+	conns    chan net.Conn
+	closing  chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	err      error
+	accepted chan struct{}
+}
+
+// New creates a new handoff listener and starts accepting connections.
+func New(ln net.Listener) *Listener {
+	l := &Listener{
+		ln:       ln,
+		conns:    make(chan net.Conn),
+		closing:  make(chan struct{}),
+		accepted: make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *Listener) run() {
+	defer close(l.accepted)
+	// Delay after temporary accept errors like net/http.Server.Serve, to
+	// avoid a busy loop when running out of file descriptors:
+	var tempDelay time.Duration
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				select {
+				case <-time.After(tempDelay):
+				case <-l.closing:
+				}
+				continue
+			}
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			return
+		}
+		tempDelay = 0
+		select {
+		case l.conns <- conn:
+		case <-l.closing:
+			conn.Close()
+			l.mu.Lock()
+			l.err = ErrClosed
+			l.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Addr returns the address of the underlying listener.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Close closes the underlying listener and thereby all views.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closing)
+		err = l.ln.Close()
+	})
+	return err
+}
+
+// View returns a new view of the listener.
+// Closing a view stops it from accepting connections, but leaves the
+// underlying listener and other views open.
+func (l *Listener) View() net.Listener {
+	return &view{Listener: l, done: make(chan struct{})}
+}
+
+type view struct {
+	*Listener
+	once sync.Once
+	done chan struct{}
+}
+
+// Accept waits for and returns the next connection of the underlying listener.
+// Returns the error of the underlying listener once it failed or was closed.
+func (v *view) Accept() (net.Conn, error) {
+	select {
+	case conn := <-v.conns:
+		return conn, nil
+	case <-v.accepted:
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		if v.err == nil {
+			return nil, ErrClosed
+		}
+		return nil, v.err
+	case <-v.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops the view from accepting connections.
+func (v *view) Close() error {
+	v.once.Do(func() {
+		close(v.done)
+	})
+	return nil
+}
@@ -0,0 +1,135 @@
+package handoff
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary failure" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+type failingListener struct {
+	net.Listener
+	accepts chan time.Time
+}
+
+func (f *failingListener) Accept() (net.Conn, error) {
+	select {
+	case f.accepts <- time.Now():
+		return nil, tempError{}
+	default:
+		// Once the test stops reading, wait for the listener to be closed:
+		return f.Listener.Accept()
+	}
+}
+
+func listenerHelper(t *testing.T) *Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err)
+	}
+	return New(ln)
+}
+
+func dialHelper(t *testing.T, l *Listener) net.Conn {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %s", err)
+	}
+	return conn
+}
+
+func TestView(t *testing.T) {
+	l := listenerHelper(t)
+	defer l.Close()
+	first := l.View()
+	client := dialHelper(t, l)
+	defer client.Close()
+	conn, err := first.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected accept error: %s", err)
+	}
+	conn.Close()
+	first.Close()
+	if _, err := first.Accept(); err != ErrClosed {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, ErrClosed)
+	}
+	second := l.View()
+	client = dialHelper(t, l)
+	defer client.Close()
+	conn, err = second.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected accept error: %s", err)
+	}
+	conn.Close()
+}
+
+func TestClose(t *testing.T) {
+	l := listenerHelper(t)
+	v := l.View()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := v.Accept()
+		errs <- err
+	}()
+	if err := l.Close(); err != nil {
+		t.Errorf("Unexpected close error: %s", err)
+	}
+	if err := <-errs; err == nil || err == ErrClosed {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("Unexpected repeated close error: %s", err)
+	}
+}
+
+type pendingListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (p *pendingListener) Accept() (net.Conn, error) {
+	if conn := p.conn; conn != nil {
+		p.conn = nil
+		return conn, nil
+	}
+	return p.Listener.Accept()
+}
+
+func TestCloseWithPendingConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	l := New(&pendingListener{Listener: ln, conn: server})
+	l.Close()
+	<-l.accepted
+	conn, err := l.View().Accept()
+	if conn != nil || err == nil {
+		t.Errorf("Unexpected accept result: %v, %v", conn, err)
+	}
+}
+
+func TestTemporaryErrorBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err)
+	}
+	f := &failingListener{Listener: ln, accepts: make(chan time.Time, 4)}
+	l := New(f)
+	prev := <-f.accepts
+	for expected := 5 * time.Millisecond; expected <= 20*time.Millisecond; expected *= 2 {
+		next := <-f.accepts
+		if delay := next.Sub(prev); delay < expected {
+			t.Errorf("Unexpected accept delay: %s. Expected: %s", delay, expected)
+		}
+		prev = next
+	}
+	l.Close()
+}
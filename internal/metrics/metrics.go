@@ -0,0 +1,330 @@
+/*
+Package metrics provides counters and histograms in the Prometheus text
+exposition format.
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// Connections counts accepted client connections.
+	Connections = NewCounter(
+		"aws_smtp_relay_connections_total",
+		"Number of accepted client connections.",
+	)
+	// Auth counts authentication attempts by mechanism and result.
+	Auth = NewCounter(
+		"aws_smtp_relay_auth_total",
+		"Number of authentication attempts.",
+		"mechanism",
+		"result",
+	)
+	// Messages counts processed emails by result and reason.
+	Messages = NewCounter(
+		"aws_smtp_relay_messages_total",
+		"Number of processed emails.",
+		"result",
+		"reason",
+	)
+	// Recipients observes the number of recipients per email.
+	Recipients = NewHistogram(
+		"aws_smtp_relay_message_recipients",
+		"Number of recipients per email.",
+		[]float64{1, 2, 5, 10, 20, 50, 100},
+	)
+	// MessageSize observes the size of emails in bytes.
+	MessageSize = NewHistogram(
+		"aws_smtp_relay_message_size_bytes",
+		"Size of emails in bytes.",
+		[]float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 40 << 20},
+	)
+	// APIDuration observes the latency of AWS API requests by backend.
+	APIDuration = NewHistogram(
+		"aws_smtp_relay_api_request_duration_seconds",
+		"Duration of AWS API requests in seconds.",
+		[]float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+		"backend",
+	)
+)
+
+var (
+	mu       sync.Mutex
+	registry []metric
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func register(m metric) {
+	mu.Lock()
+	registry = append(registry, m)
+	mu.Unlock()
+}
+
+// vec holds the samples of a metric, keyed by their label values.
+type vec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	mu      sync.Mutex
+	samples map[string]interface{}
+}
+
+func (v *vec) sample(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf(
+			"metrics: %s expects %d label values, got %d",
+			v.name,
+			len(v.labels),
+			len(values),
+		))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.samples[key]
+	if !ok {
+		s = create()
+		v.samples[key] = s
+	}
+	return s
+}
+
+func (v *vec) keys() []string {
+	keys := make([]string, 0, len(v.samples))
+	for key := range v.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+// Counter is a monotonically increasing metric with optional labels.
+type Counter struct {
+	vec
+}
+
+type counterSample struct {
+	values []string
+	value  float64
+}
+
+// NewCounter creates and registers a new counter.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec{
+		name:    name,
+		help:    help,
+		kind:    "counter",
+		labels:  labels,
+		samples: make(map[string]interface{}),
+	}}
+	register(c)
+	return c
+}
+
+// Add adds the given value to the counter with the given label values.
+func (c *Counter) Add(value float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.sample(values, func() interface{} {
+		return &counterSample{values: values}
+	}).(*counterSample)
+	s.value += value
+}
+
+// Inc increments the counter with the given label values by one.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value returns the current value of the counter with the given label values.
+func (c *Counter) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.samples[strings.Join(values, "\xff")]; ok {
+		return s.(*counterSample).value
+	}
+	return 0
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, key := range c.keys() {
+		s := c.samples[key].(*counterSample)
+		fmt.Fprintf(
+			w,
+			"%s%s %s\n",
+			c.name,
+			formatLabels(c.labels, s.values, "", ""),
+			formatValue(s.value),
+		)
+	}
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	vec
+	buckets []float64
+}
+
+type histogramSample struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a new histogram with the given upper
+// bucket bounds in increasing order.
+func NewHistogram(
+	name string,
+	help string,
+	buckets []float64,
+	labels ...string,
+) *Histogram {
+	h := &Histogram{
+		vec: vec{
+			name:    name,
+			help:    help,
+			kind:    "histogram",
+			labels:  labels,
+			samples: make(map[string]interface{}),
+		},
+		buckets: buckets,
+	}
+	register(h)
+	return h
+}
+
+// Observe adds an observation to the histogram with the given label values.
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.sample(values, func() interface{} {
+		return &histogramSample{
+			values: values,
+			counts: make([]uint64, len(h.buckets)),
+		}
+	}).(*histogramSample)
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Count returns the number of observations with the given label values.
+func (h *Histogram) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.samples[strings.Join(values, "\xff")]; ok {
+		return s.(*histogramSample).count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, key := range h.keys() {
+		s := h.samples[key].(*histogramSample)
+		for i, bound := range h.buckets {
+			fmt.Fprintf(
+				w,
+				"%s_bucket%s %d\n",
+				h.name,
+				formatLabels(h.labels, s.values, "le", formatValue(bound)),
+				s.counts[i],
+			)
+		}
+		fmt.Fprintf(
+			w,
+			"%s_bucket%s %d\n",
+			h.name,
+			formatLabels(h.labels, s.values, "le", "+Inf"),
+			s.count,
+		)
+		labels := formatLabels(h.labels, s.values, "", "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, s.count)
+	}
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelValueReplacer.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Write writes all registered metrics in the Prometheus text format.
+func Write(w io.Writer) {
+	mu.Lock()
+	metrics := registry
+	mu.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler returns an HTTP handler serving all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+type listener struct {
+	net.Listener
+}
+
+// Accept waits for and returns the next connection and counts it.
+func (l listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		Connections.Inc()
+	}
+	return c, err
+}
+
+// NewListener wraps the given listener to count accepted connections.
+func NewListener(l net.Listener) net.Listener {
+	return listener{l}
+}
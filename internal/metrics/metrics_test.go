@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "Test counter.", "result")
+	c.Inc("ok")
+	c.Add(2, "ok")
+	c.Inc("fail\"ed")
+	if c.Value("ok") != 3 {
+		t.Errorf("Unexpected counter value: %f. Expected: %d", c.Value("ok"), 3)
+	}
+	var b bytes.Buffer
+	c.write(&b)
+	expected := `# HELP test_counter_total Test counter.
+# TYPE test_counter_total counter
+test_counter_total{result="fail\"ed"} 1
+test_counter_total{result="ok"} 3
+`
+	if b.String() != expected {
+		t.Errorf("Unexpected output: %s. Expected: %s", b.String(), expected)
+	}
+}
+
+func TestCounterWithInvalidLabels(t *testing.T) {
+	c := NewCounter("test_invalid_total", "Test counter.", "result")
+	defer func() {
+		if recover() == nil {
+			t.Error("Unexpected missing panic")
+		}
+	}()
+	c.Inc()
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_histogram", "Test histogram.", []float64{1, 5})
+	h.Observe(0.5)
+	h.Observe(3)
+	h.Observe(10)
+	if h.Count() != 3 {
+		t.Errorf("Unexpected histogram count: %d. Expected: %d", h.Count(), 3)
+	}
+	var b bytes.Buffer
+	h.write(&b)
+	expected := `# HELP test_histogram Test histogram.
+# TYPE test_histogram histogram
+test_histogram_bucket{le="1"} 1
+test_histogram_bucket{le="5"} 2
+test_histogram_bucket{le="+Inf"} 3
+test_histogram_sum 13.5
+test_histogram_count 3
+`
+	if b.String() != expected {
+		t.Errorf("Unexpected output: %s. Expected: %s", b.String(), expected)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	Messages.Inc("accepted", "")
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected content type: %s", rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, s := range []string{
+		"# TYPE aws_smtp_relay_connections_total counter",
+		`aws_smtp_relay_messages_total{result="accepted",reason=""}`,
+		"# TYPE aws_smtp_relay_api_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Unexpected missing output: %s", s)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err)
+	}
+	ln = NewListener(ln)
+	defer ln.Close()
+	before := Connections.Value()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected accept error: %s", err)
+	}
+	conn.Close()
+	if Connections.Value() != before+1 {
+		t.Errorf("Unexpected connections: %f. Expected: %f", Connections.Value(), before+1)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Package network provides parsing and matching of IP addresses and CIDR ranges.
+*/
+package network
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// List is a list of IP networks.
+type List []*net.IPNet
+
+// Contains reports whether any network of the list contains the given IP.
+func (l List) Contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse parses an IP address or a CIDR range, e.g. "10.0.0.0/16" or "fd00::/8".
+// A single IP address is parsed as network with a full prefix length.
+func Parse(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid IP address: " + s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+// ParseList parses a comma-separated list of IP addresses and CIDR ranges.
+// Surrounding whitespace and empty entries are ignored.
+func ParseList(s string) (List, error) {
+	var l List
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ipNet, err := Parse(entry)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, ipNet)
+	}
+	return l, nil
+}
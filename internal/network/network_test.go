@@ -0,0 +1,78 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]string{
+		"127.0.0.1":            "127.0.0.1/32",
+		"::1":                  "::1/128",
+		"2001:4860:0:2001::68": "2001:4860:0:2001::68/128",
+		"10.0.0.0/16":          "10.0.0.0/16",
+		"10.0.1.2/16":          "10.0.0.0/16",
+		"fd00::/8":             "fd00::/8",
+	}
+	for s, expected := range tests {
+		ipNet, err := Parse(s)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", s, err)
+			continue
+		}
+		if ipNet.String() != expected {
+			t.Errorf("Unexpected network: %s. Expected: %s", ipNet, expected)
+		}
+	}
+}
+
+func TestParseWithInvalidInput(t *testing.T) {
+	for _, s := range []string{"invalid", "127.0.0.256", "10.0.0.0/33", "::/129"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Unexpected nil error for %s", s)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	l, err := ParseList("127.0.0.1, 10.0.0.0/16,,fd00::/8")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if len(l) != 3 {
+		t.Errorf("Unexpected list length: %d. Expected: %d", len(l), 3)
+	}
+	l, err = ParseList("")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if l != nil {
+		t.Errorf("Unexpected list: %v. Expected: %v", l, nil)
+	}
+	_, err = ParseList("127.0.0.1,invalid")
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestContains(t *testing.T) {
+	l, _ := ParseList("127.0.0.1,10.0.0.0/16,fd00::/8")
+	tests := map[string]bool{
+		"127.0.0.1":        true,
+		"::ffff:127.0.0.1": true,
+		"127.0.0.2":        false,
+		"10.0.255.1":       true,
+		"10.1.0.1":         false,
+		"fd12:3456::1":     true,
+		"FD00:0:0::0001":   true,
+		"fe80::1":          false,
+	}
+	for s, expected := range tests {
+		if l.Contains(net.ParseIP(s)) != expected {
+			t.Errorf("Unexpected result for %s. Expected: %t", s, expected)
+		}
+	}
+	if l.Contains(nil) {
+		t.Error("Unexpected result for nil IP. Expected: false")
+	}
+}
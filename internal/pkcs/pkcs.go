@@ -0,0 +1,492 @@
+/*
+Package pkcs provides decoding of PKCS#8 encrypted private keys and PKCS#12
+bundles, as written by current OpenSSL versions.
+*/
+package pkcs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"hash"
+	"math/big"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/pkcs12"
+)
+
+var (
+	oidPBES2              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidPBEWithSHAAnd3DES  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHA         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1}
+	oidHMACWithSHA1       = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidSHA1               = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidAES128CBC          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC         = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidData               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKey   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	errDecryption         = errors.New("Decryption failed, invalid passphrase?")
+	errLegacy             = errors.New("Legacy PKCS#12 encryption")
+	errUnsupportedKDF     = errors.New("Unsupported key derivation function")
+	errUnsupportedCipher  = errors.New("Unsupported encryption scheme")
+	errUnsupportedHash    = errors.New("Unsupported hash algorithm")
+	errIncorrectPassword  = errors.New("PKCS#12 MAC verification failed, invalid passphrase?")
+	errMissingPrivateKey  = errors.New("PKCS#12 bundle contains no private key")
+	errMissingCertificate = errors.New("PKCS#12 bundle contains no certificate")
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue   `asn1:"tag:0,explicit"`
+	Attributes []asn1.RawValue `asn1:"set,optional"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// hmacHash returns the hash function for the given PBKDF2 PRF algorithm.
+// A missing PRF defaults to HMAC-SHA1.
+func hmacHash(prf pkix.AlgorithmIdentifier) (func() hash.Hash, error) {
+	switch {
+	case len(prf.Algorithm) == 0, prf.Algorithm.Equal(oidHMACWithSHA1):
+		return sha1.New, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA224):
+		return sha256.New224, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA256):
+		return sha256.New, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA384):
+		return sha512.New384, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA512):
+		return sha512.New, nil
+	}
+	return nil, errUnsupportedHash
+}
+
+// digestHash returns the hash function for the given digest algorithm.
+func digestHash(alg pkix.AlgorithmIdentifier) (func() hash.Hash, error) {
+	switch {
+	case alg.Algorithm.Equal(oidSHA1):
+		return sha1.New, nil
+	case alg.Algorithm.Equal(oidSHA256):
+		return sha256.New, nil
+	case alg.Algorithm.Equal(oidSHA384):
+		return sha512.New384, nil
+	case alg.Algorithm.Equal(oidSHA512):
+		return sha512.New, nil
+	}
+	return nil, errUnsupportedHash
+}
+
+// bmpString returns the password as null-terminated UTF-16 big-endian string,
+// as used for the PKCS#12 key derivation.
+func bmpString(password string) []byte {
+	runes := utf16.Encode([]rune(password))
+	b := make([]byte, 0, 2*len(runes)+2)
+	for _, r := range runes {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return append(b, 0, 0)
+}
+
+// fill returns the given bytes repeated to a multiple of the block size.
+func fill(b []byte, v int) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	out := make([]byte, v*((len(b)+v-1)/v))
+	for i := range out {
+		out[i] = b[i%len(b)]
+	}
+	return out
+}
+
+// pkcs12KDF derives key material as defined in RFC 7292, appendix B.2.
+// id is 1 for encryption keys, 2 for IVs and 3 for MAC keys.
+func pkcs12KDF(h func() hash.Hash, id byte, password, salt []byte, iterations, size int) []byte {
+	v := h().BlockSize()
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt, v), fill(password, v)...)
+	one := big.NewInt(1)
+	var out []byte
+	for len(out) < size {
+		digest := h()
+		digest.Write(d)
+		digest.Write(i)
+		a := digest.Sum(nil)
+		for r := 1; r < iterations; r++ {
+			digest.Reset()
+			digest.Write(a)
+			a = digest.Sum(a[:0])
+		}
+		out = append(out, a...)
+		b := new(big.Int).SetBytes(fill(a, v))
+		b.Add(b, one)
+		for j := 0; j < len(i); j += v {
+			block := new(big.Int).SetBytes(i[j : j+v])
+			block.Add(block, b)
+			sum := block.Bytes()
+			if len(sum) > v {
+				sum = sum[len(sum)-v:]
+			}
+			copy(i[j:j+v], make([]byte, v-len(sum)))
+			copy(i[j+v-len(sum):j+v], sum)
+		}
+	}
+	return out[:size]
+}
+
+// unpad removes and validates PKCS#7 padding.
+func unpad(b []byte, blockSize int) ([]byte, error) {
+	if len(b) == 0 || len(b)%blockSize != 0 {
+		return nil, errDecryption
+	}
+	n := int(b[len(b)-1])
+	if n == 0 || n > blockSize || n > len(b) {
+		return nil, errDecryption
+	}
+	for _, c := range b[len(b)-n:] {
+		if int(c) != n {
+			return nil, errDecryption
+		}
+	}
+	return b[:len(b)-n], nil
+}
+
+// decryptCBC decrypts the given data in CBC mode and removes the padding.
+func decryptCBC(block cipher.Block, iv, data []byte) ([]byte, error) {
+	if len(iv) != block.BlockSize() || len(data)%block.BlockSize() != 0 {
+		return nil, errDecryption
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	return unpad(out, block.BlockSize())
+}
+
+// decryptPBES2 decrypts data encrypted with the PBES2 scheme of RFC 8018.
+func decryptPBES2(params, data []byte, password string) ([]byte, error) {
+	var p pbes2Params
+	if _, err := asn1.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	if !p.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, errUnsupportedKDF
+	}
+	var kdf pbkdf2Params
+	_, err := asn1.Unmarshal(p.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	if err != nil {
+		return nil, err
+	}
+	h, err := hmacHash(kdf.PRF)
+	if err != nil {
+		return nil, err
+	}
+	var keyLen int
+	var newCipher func(key []byte) (cipher.Block, error)
+	switch alg := p.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case alg.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case alg.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case alg.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, errUnsupportedCipher
+	}
+	var iv []byte
+	_, err = asn1.Unmarshal(p.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil {
+		return nil, err
+	}
+	key := pbkdf2.Key([]byte(password), kdf.Salt, kdf.IterationCount, keyLen, h)
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return decryptCBC(block, iv, data)
+}
+
+// decryptPBE decrypts data encrypted with the PKCS#12 password based scheme
+// using SHA-1 and 3-key triple DES.
+func decryptPBE(params, data []byte, password string) ([]byte, error) {
+	var p pbeParams
+	if _, err := asn1.Unmarshal(params, &p); err != nil {
+		return nil, err
+	}
+	pass := bmpString(password)
+	key := pkcs12KDF(sha1.New, 1, pass, p.Salt, p.Iterations, 24)
+	iv := pkcs12KDF(sha1.New, 2, pass, p.Salt, p.Iterations, 8)
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return decryptCBC(block, iv, data)
+}
+
+// decrypt decrypts data with the given encryption algorithm.
+func decrypt(alg pkix.AlgorithmIdentifier, data []byte, password string) ([]byte, error) {
+	switch {
+	case alg.Algorithm.Equal(oidPBES2):
+		return decryptPBES2(alg.Parameters.FullBytes, data, password)
+	case alg.Algorithm.Equal(oidPBEWithSHAAnd3DES):
+		return decryptPBE(alg.Parameters.FullBytes, data, password)
+	case len(alg.Algorithm) > len(oidPBEWithSHA) &&
+		alg.Algorithm[:len(oidPBEWithSHA)].Equal(oidPBEWithSHA):
+		return nil, errLegacy
+	}
+	return nil, errUnsupportedCipher
+}
+
+// DecryptPrivateKey decrypts and parses a DER encoded PKCS#8
+// EncryptedPrivateKeyInfo structure, as found in PEM blocks of type
+// "ENCRYPTED PRIVATE KEY".
+func DecryptPrivateKey(der []byte, password string) (crypto.PrivateKey, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	keyDER, err := decrypt(info.Algorithm, info.EncryptedData, password)
+	if err == errLegacy {
+		err = errUnsupportedCipher
+	}
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKCS8PrivateKey(keyDER)
+}
+
+// verifyMAC verifies the integrity of the PKCS#12 authenticated safe.
+func verifyMAC(m *macData, content []byte, password string) error {
+	h, err := digestHash(m.Mac.Algorithm)
+	if err != nil {
+		return err
+	}
+	key := pkcs12KDF(h, 3, bmpString(password), m.MacSalt, m.Iterations, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), m.Mac.Digest) {
+		return errIncorrectPassword
+	}
+	return nil
+}
+
+// decodeBags decodes the safe bags of the given PKCS#12 bundle.
+func decodeBags(data []byte, password string) (bags []safeBag, err error) {
+	var pfx pfxPdu
+	if _, err = asn1.Unmarshal(data, &pfx); err != nil {
+		return
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidData) {
+		return nil, errUnsupportedCipher
+	}
+	var content []byte
+	if _, err = asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &content); err != nil {
+		return
+	}
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) > 0 {
+		if err = verifyMAC(&pfx.MacData, content, password); err != nil {
+			return
+		}
+	}
+	var safes []contentInfo
+	if _, err = asn1.Unmarshal(content, &safes); err != nil {
+		return
+	}
+	for _, ci := range safes {
+		var safe []byte
+		switch {
+		case ci.ContentType.Equal(oidData):
+			_, err = asn1.Unmarshal(ci.Content.Bytes, &safe)
+		case ci.ContentType.Equal(oidEncryptedData):
+			var ed encryptedData
+			_, err = asn1.Unmarshal(ci.Content.Bytes, &ed)
+			if err == nil {
+				info := ed.EncryptedContentInfo
+				safe, err = decrypt(
+					info.ContentEncryptionAlgorithm,
+					info.EncryptedContent,
+					password,
+				)
+			}
+		default:
+			err = errUnsupportedCipher
+		}
+		if err != nil {
+			return
+		}
+		var contents []safeBag
+		if _, err = asn1.Unmarshal(safe, &contents); err != nil {
+			return
+		}
+		bags = append(bags, contents...)
+	}
+	return
+}
+
+// DecodeBundle decodes a DER encoded PKCS#12 bundle and returns its private
+// key and certificates.
+// Bundles using the legacy RC2 or RC4 based encryption schemes are decoded via
+// golang.org/x/crypto/pkcs12.
+func DecodeBundle(data []byte, password string) (
+	key crypto.PrivateKey,
+	certs []*x509.Certificate,
+	err error,
+) {
+	bags, err := decodeBags(data, password)
+	if err == errLegacy {
+		return decodeLegacyBundle(data, password)
+	}
+	if err != nil {
+		return
+	}
+	for _, bag := range bags {
+		switch {
+		case bag.ID.Equal(oidCertBag):
+			var cb certBag
+			if _, err = asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+				return
+			}
+			if !cb.ID.Equal(oidX509Certificate) {
+				continue
+			}
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(cb.Data); err != nil {
+				return
+			}
+			certs = append(certs, cert)
+		case bag.ID.Equal(oidKeyBag) && key == nil:
+			if key, err = x509.ParsePKCS8PrivateKey(bag.Value.Bytes); err != nil {
+				return
+			}
+		case bag.ID.Equal(oidPKCS8ShroudedKey) && key == nil:
+			if key, err = DecryptPrivateKey(bag.Value.Bytes, password); err != nil {
+				return
+			}
+		}
+	}
+	return key, certs, checkBundle(key, certs)
+}
+
+// decodeLegacyBundle decodes a PKCS#12 bundle via golang.org/x/crypto/pkcs12.
+func decodeLegacyBundle(data []byte, password string) (
+	key crypto.PrivateKey,
+	certs []*x509.Certificate,
+	err error,
+) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return
+	}
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY":
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+				continue
+			}
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return
+			}
+		}
+	}
+	return key, certs, checkBundle(key, certs)
+}
+
+// checkBundle returns an error if the key or certificates are missing.
+func checkBundle(key crypto.PrivateKey, certs []*x509.Certificate) error {
+	if key == nil {
+		return errMissingPrivateKey
+	}
+	if len(certs) == 0 {
+		return errMissingCertificate
+	}
+	return nil
+}
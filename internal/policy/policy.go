@@ -0,0 +1,206 @@
+/*
+Package policy provides per-user and per-network sender and recipient policies.
+*/
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+
+	"github.com/blueimp/aws-smtp-relay/internal/network"
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
+	"github.com/blueimp/aws-smtp-relay/internal/smtpd"
+)
+
+// replyTooManyRecipients is the RFC 5321 reply for recipients exceeding the
+// maximum number per email, which a client may send in another transaction.
+var replyTooManyRecipients = smtpd.Error{
+	Code:    452,
+	Message: "4.5.3 Too many recipients",
+}
+
+// Policy restricts the senders and recipients of emails.
+type Policy struct {
+	AllowFrom     *regexp.Regexp
+	DenyTo        *regexp.Regexp
+	MaxRecipients int
+}
+
+// Config holds the settings of a policy, with regular expressions as strings.
+type Config struct {
+	AllowFrom     string `yaml:"allowFrom"`
+	DenyTo        string `yaml:"denyTo"`
+	MaxRecipients int    `yaml:"maxRecipients"`
+}
+
+type networkPolicy struct {
+	ipNet  *net.IPNet
+	policy *Policy
+}
+
+// Policies implements the smtpd HandlerMail and HandlerRcpt interfaces.
+type Policies struct {
+	global   *Policy
+	users    map[string]*Policy
+	networks []networkPolicy
+}
+
+// Lookup returns the policy for the given session address.
+// The policy of the authenticated user takes precedence over the policy of the
+// most specific network containing the client IP.
+// Returns nil if no policy applies.
+func (p *Policies) Lookup(addr net.Addr) *Policy {
+	if policy, ok := p.users[session.User(addr)]; ok {
+		return policy
+	}
+	ip := session.IP(addr)
+	for _, n := range p.networks {
+		if n.ipNet.Contains(ip) {
+			return n.policy
+		}
+	}
+	return nil
+}
+
+// applicable returns the global policy, if set, and the looked up policy for
+// the given session address.
+func (p *Policies) applicable(addr net.Addr) []*Policy {
+	policies := make([]*Policy, 0, 2)
+	if p.global != nil {
+		policies = append(policies, p.global)
+	}
+	if policy := p.Lookup(addr); policy != nil {
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+// HandlerMail validates the sender of an email.
+func (p *Policies) HandlerMail(remoteAddr net.Addr, from string) bool {
+	if addr, ok := remoteAddr.(*session.Addr); ok {
+		addr.Recipients = 0
+	}
+	for _, policy := range p.applicable(remoteAddr) {
+		if policy.AllowFrom != nil && !policy.AllowFrom.MatchString(from) {
+			relay.Log(remoteAddr, &from, nil, relay.ErrDeniedSender)
+			return false
+		}
+	}
+	return true
+}
+
+// HandlerRcpt validates a recipient of an email.
+// Returns relay.ErrDeniedRecipients for denied recipients and an smtpd.Error
+// with a 452 reply for recipients exceeding the maximum.
+func (p *Policies) HandlerRcpt(
+	remoteAddr net.Addr,
+	from string,
+	to string,
+) error {
+	addr, _ := remoteAddr.(*session.Addr)
+	for _, policy := range p.applicable(remoteAddr) {
+		var err error
+		if policy.DenyTo != nil && policy.DenyTo.MatchString(to) {
+			err = relay.ErrDeniedRecipients
+		} else if policy.MaxRecipients > 0 && addr != nil &&
+			addr.Recipients >= policy.MaxRecipients {
+			err = relay.ErrTooManyRecipients
+		}
+		if err != nil {
+			relay.Log(remoteAddr, &from, []*string{&to}, err)
+			if err == relay.ErrTooManyRecipients {
+				return replyTooManyRecipients
+			}
+			return err
+		}
+	}
+	if addr != nil {
+		addr.Recipients++
+	}
+	return nil
+}
+
+func compile(name string, config Config) (policy *Policy, err error) {
+	policy = &Policy{MaxRecipients: config.MaxRecipients}
+	if config.AllowFrom != "" {
+		policy.AllowFrom, err = regexp.Compile(config.AllowFrom)
+		if err != nil {
+			return nil, errors.New(name + ": AllowFrom: " + err.Error())
+		}
+	}
+	if config.DenyTo != "" {
+		policy.DenyTo, err = regexp.Compile(config.DenyTo)
+		if err != nil {
+			return nil, errors.New(name + ": DenyTo: " + err.Error())
+		}
+	}
+	return
+}
+
+// New creates a new Policies config.
+// users maps usernames and ips maps IPs or CIDR ranges to policy configs.
+func New(
+	users map[string]Config,
+	ips map[string]Config,
+) (*Policies, error) {
+	p := &Policies{users: make(map[string]*Policy)}
+	for name, config := range users {
+		policy, err := compile(name, config)
+		if err != nil {
+			return nil, err
+		}
+		p.users[name] = policy
+	}
+	for s, config := range ips {
+		ipNet, err := network.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		policy, err := compile(s, config)
+		if err != nil {
+			return nil, err
+		}
+		p.networks = append(p.networks, networkPolicy{ipNet: ipNet, policy: policy})
+	}
+	// Sort networks by prefix length, so that the most specific matches first:
+	sort.Slice(p.networks, func(i, j int) bool {
+		iOnes, _ := p.networks[i].ipNet.Mask.Size()
+		jOnes, _ := p.networks[j].ipNet.Mask.Size()
+		return iOnes > jOnes
+	})
+	return p, nil
+}
+
+// Global returns a copy of the given policies, which additionally applies the
+// given policy to all sessions, e.g. the globally allowed senders and denied
+// recipients.
+// p may be nil, in which case only the given policy applies.
+func Global(policy *Policy, p *Policies) *Policies {
+	global := &Policies{global: policy}
+	if p != nil {
+		global.users = p.users
+		global.networks = p.networks
+	}
+	return global
+}
+
+// Read reads policies from a JSON file.
+func Read(name string) (*Policies, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var configs struct {
+		Users map[string]Config
+		IPs   map[string]Config
+	}
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, err
+	}
+	return New(configs.Users, configs.IPs)
+}
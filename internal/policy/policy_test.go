@@ -0,0 +1,217 @@
+package policy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
+	"github.com/blueimp/aws-smtp-relay/internal/smtpd"
+)
+
+func policiesHelper(t *testing.T) *Policies {
+	p, err := New(
+		map[string]Config{
+			"billing": {
+				AllowFrom:     `^billing@example\.org$`,
+				DenyTo:        `@lists\.example\.org$`,
+				MaxRecipients: 2,
+			},
+		},
+		map[string]Config{
+			"10.0.0.0/8":  {AllowFrom: `@example\.org$`},
+			"10.1.0.0/16": {AllowFrom: `@example\.com$`},
+			"fd00::1":     {DenyTo: `^admin@`},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return p
+}
+
+func addrHelper(ip net.IP, user string) *session.Addr {
+	return &session.Addr{TCPAddr: net.TCPAddr{IP: ip}, User: user}
+}
+
+// silence redirects stdout to /dev/null while executing the given function.
+func silence(fn func()) {
+	originalOut := os.Stdout
+	defer func() {
+		os.Stdout = originalOut
+	}()
+	os.Stdout, _ = os.Open(os.DevNull)
+	fn()
+}
+
+func TestLookup(t *testing.T) {
+	p := policiesHelper(t)
+	policy := p.Lookup(addrHelper(net.ParseIP("10.1.2.3"), "billing"))
+	if policy != p.users["billing"] {
+		t.Errorf("Unexpected policy: %v. Expected user policy.", policy)
+	}
+	policy = p.Lookup(addrHelper(net.ParseIP("10.1.2.3"), ""))
+	if policy == nil || policy.AllowFrom.String() != `@example\.com$` {
+		t.Errorf("Unexpected policy: %v. Expected /16 network policy.", policy)
+	}
+	policy = p.Lookup(addrHelper(net.ParseIP("10.2.0.1"), "alice"))
+	if policy == nil || policy.AllowFrom.String() != `@example\.org$` {
+		t.Errorf("Unexpected policy: %v. Expected /8 network policy.", policy)
+	}
+	policy = p.Lookup(&net.TCPAddr{IP: net.ParseIP("fd00::1")})
+	if policy == nil || policy.DenyTo.String() != `^admin@` {
+		t.Errorf("Unexpected policy: %v. Expected IPv6 policy.", policy)
+	}
+	policy = p.Lookup(addrHelper(net.ParseIP("192.168.0.1"), ""))
+	if policy != nil {
+		t.Errorf("Unexpected policy: %v. Expected: %v", policy, nil)
+	}
+}
+
+func TestHandlerMail(t *testing.T) {
+	p := policiesHelper(t)
+	addr := addrHelper(net.ParseIP("127.0.0.1"), "billing")
+	addr.Recipients = 1
+	var accepted bool
+	silence(func() { accepted = p.HandlerMail(addr, "billing@example.org") })
+	if !accepted {
+		t.Error("Unexpected sender rejection")
+	}
+	if addr.Recipients != 0 {
+		t.Errorf("Unexpected recipients count: %d. Expected: %d", addr.Recipients, 0)
+	}
+	silence(func() { accepted = p.HandlerMail(addr, "admin@example.org") })
+	if accepted {
+		t.Error("Unexpected sender acceptance")
+	}
+	addr = addrHelper(net.ParseIP("127.0.0.1"), "")
+	silence(func() { accepted = p.HandlerMail(addr, "admin@example.org") })
+	if !accepted {
+		t.Error("Unexpected sender rejection without policy")
+	}
+}
+
+func TestHandlerRcpt(t *testing.T) {
+	p := policiesHelper(t)
+	addr := addrHelper(net.ParseIP("127.0.0.1"), "billing")
+	from := "billing@example.org"
+	var err error
+	silence(func() { err = p.HandlerRcpt(addr, from, "all@lists.example.org") })
+	if err != relay.ErrDeniedRecipients {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, relay.ErrDeniedRecipients)
+	}
+	silence(func() { err = p.HandlerRcpt(addr, from, "alice@example.org") })
+	if err != nil {
+		t.Errorf("Unexpected recipient rejection: %s", err)
+	}
+	silence(func() { err = p.HandlerRcpt(addr, from, "bob@example.org") })
+	if err != nil {
+		t.Errorf("Unexpected recipient rejection: %s", err)
+	}
+	silence(func() { err = p.HandlerRcpt(addr, from, "charlie@example.org") })
+	var smtpErr smtpd.Error
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 452 ||
+		smtpErr.Message != "4.5.3 Too many recipients" {
+		t.Errorf("Unexpected error for recipient exceeding the maximum: %v", err)
+	}
+	silence(func() { p.HandlerMail(addr, from) })
+	silence(func() { err = p.HandlerRcpt(addr, from, "charlie@example.org") })
+	if err != nil {
+		t.Errorf("Unexpected recipient rejection after new MAIL command: %s", err)
+	}
+}
+
+func TestGlobal(t *testing.T) {
+	global := &Policy{
+		AllowFrom: regexp.MustCompile(`@example\.org$`),
+		DenyTo:    regexp.MustCompile(`^root@`),
+	}
+	for _, p := range []*Policies{Global(global, nil), Global(global, policiesHelper(t))} {
+		addr := addrHelper(net.ParseIP("127.0.0.1"), "billing")
+		var accepted bool
+		silence(func() { accepted = p.HandlerMail(addr, "alice@example.com") })
+		if accepted {
+			t.Error("Unexpected acceptance of sender denied by the global policy")
+		}
+		silence(func() { accepted = p.HandlerMail(addr, "billing@example.org") })
+		if !accepted {
+			t.Error("Unexpected sender rejection")
+		}
+		var err error
+		silence(func() { err = p.HandlerRcpt(addr, "billing@example.org", "root@example.org") })
+		if err == nil {
+			t.Error("Unexpected acceptance of recipient denied by the global policy")
+		}
+		silence(func() { err = p.HandlerRcpt(addr, "billing@example.org", "alice@example.org") })
+		if err != nil {
+			t.Errorf("Unexpected recipient rejection: %s", err)
+		}
+	}
+	p := Global(global, policiesHelper(t))
+	addr := addrHelper(net.ParseIP("127.0.0.1"), "billing")
+	var accepted bool
+	silence(func() { accepted = p.HandlerMail(addr, "admin@example.org") })
+	if accepted {
+		t.Error("Unexpected acceptance of sender denied by the user policy")
+	}
+}
+
+func TestNewWithInvalidConfig(t *testing.T) {
+	_, err := New(map[string]Config{"alice": {AllowFrom: "("}}, nil)
+	if err == nil {
+		t.Error("Unexpected nil error for invalid AllowFrom")
+	}
+	_, err = New(map[string]Config{"alice": {DenyTo: "("}}, nil)
+	if err == nil {
+		t.Error("Unexpected nil error for invalid DenyTo")
+	}
+	_, err = New(nil, map[string]Config{"invalid": {}})
+	if err == nil {
+		t.Error("Unexpected nil error for invalid IP")
+	}
+	_, err = New(nil, map[string]Config{"10.0.0.0/33": {}})
+	if err == nil {
+		t.Error("Unexpected nil error for invalid CIDR")
+	}
+}
+
+func TestRead(t *testing.T) {
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("Unexpected temp file creation error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{
+		"Users": {"billing": {"AllowFrom": "^billing@", "MaxRecipients": 10}},
+		"IPs": {"10.0.0.0/8": {"DenyTo": "^admin@"}}
+	}`)
+	file.Close()
+	p, err := Read(file.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if p.users["billing"].MaxRecipients != 10 {
+		t.Errorf("Unexpected user policy: %v", p.users["billing"])
+	}
+	if len(p.networks) != 1 {
+		t.Errorf("Unexpected number of networks: %d. Expected: %d", len(p.networks), 1)
+	}
+}
+
+func TestReadWithInvalidJSON(t *testing.T) {
+	file, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("Unexpected temp file creation error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{`)
+	file.Close()
+	_, err = Read(file.Name())
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
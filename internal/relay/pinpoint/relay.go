@@ -1,30 +1,152 @@
 package relay
 
 import (
+	"bytes"
 	"net"
+	"net/textproto"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/pinpointemail"
 	"github.com/aws/aws-sdk-go/service/pinpointemail/pinpointemailiface"
+	"github.com/blueimp/aws-smtp-relay/internal/metrics"
 	"github.com/blueimp/aws-smtp-relay/internal/relay"
 )
 
+// maxDestinations is the maximum number of recipients per API request.
+const maxDestinations = 50
+
+// Headers designated to set the Pinpoint fields of an email, which are removed
+// from the email data before sending.
+const (
+	headerEmailTags          = "X-Pinpoint-Email-Tags"
+	headerFeedbackForwarding = "X-Pinpoint-Feedback-Forwarding-Address"
+	headerReplyTo            = "X-Pinpoint-Reply-To-Addresses"
+)
+
 // Client implements the Relay interface.
 type Client struct {
 	pinpointAPI     pinpointemailiface.PinpointEmailAPI
 	setName         *string
+	emailTags       map[string]string
+	feedbackAddress *string
+	replyToAddrs    []string
 	allowFromRegExp *regexp.Regexp
 	denyToRegExp    *regexp.Regexp
 }
 
-// Send uses the given Pinpoint API to send email data
+// stripHeaders removes the designated headers from the header section of the
+// given email data and returns their unfolded values by canonical name.
+func stripHeaders(data []byte) (map[string]string, []byte) {
+	values := make(map[string]string)
+	var out []byte
+	var name string
+	i := 0
+	for i < len(data) {
+		end := bytes.IndexByte(data[i:], '\n') + 1
+		if end == 0 {
+			end = len(data) - i
+		}
+		line := data[i : i+end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		i += end
+		if line[0] == ' ' || line[0] == '\t' {
+			if name != "" {
+				values[name] += " " + strings.TrimSpace(string(line))
+				continue
+			}
+		} else {
+			name = ""
+			if colon := bytes.IndexByte(line, ':'); colon > 0 {
+				key := textproto.CanonicalMIMEHeaderKey(string(line[:colon]))
+				switch key {
+				case headerEmailTags, headerFeedbackForwarding, headerReplyTo:
+					name = key
+					values[name] = strings.TrimSpace(string(line[colon+1:]))
+					continue
+				}
+			}
+		}
+		out = append(out, line...)
+	}
+	if len(values) == 0 {
+		return values, data
+	}
+	return values, append(out, data[i:]...)
+}
+
+// splitList splits the given comma-separated list and trims its values.
+func splitList(s string) []string {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// messageTags returns the given tags sorted by name, with the name=value pairs
+// of the tags header overriding tags with the same name.
+func messageTags(
+	tags map[string]string,
+	header string,
+) []*pinpointemail.MessageTag {
+	merged := make(map[string]string, len(tags))
+	for name, value := range tags {
+		merged[name] = value
+	}
+	for _, pair := range splitList(header) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 {
+			merged[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var messageTags []*pinpointemail.MessageTag
+	for k := range names {
+		value := merged[names[k]]
+		messageTags = append(
+			messageTags,
+			&pinpointemail.MessageTag{Name: &names[k], Value: &value},
+		)
+	}
+	return messageTags
+}
+
+// Send uses the given Pinpoint API to send email data.
+// The email tags, feedback forwarding address and reply-to addresses can be
+// set per email via designated headers, which are removed before sending.
 func (c Client) Send(
 	origin net.Addr,
 	from string,
 	to []string,
 	data []byte,
 ) error {
+	headers, data := stripHeaders(data)
+	tags := messageTags(c.emailTags, headers[headerEmailTags])
+	feedbackAddress := c.feedbackAddress
+	if value := headers[headerFeedbackForwarding]; value != "" {
+		feedbackAddress = &value
+	}
+	replyToAddrs := c.replyToAddrs
+	if value := headers[headerReplyTo]; value != "" {
+		replyToAddrs = splitList(value)
+	}
+	var replyTo []*string
+	if len(replyToAddrs) > 0 {
+		replyTo = aws.StringSlice(replyToAddrs)
+	}
 	allowedRecipients, deniedRecipients, err := relay.FilterAddresses(
 		from,
 		to,
@@ -35,36 +157,83 @@ func (c Client) Send(
 		relay.Log(origin, &from, deniedRecipients, err)
 	}
 	if len(allowedRecipients) > 0 {
-		_, err := c.pinpointAPI.SendEmail(&pinpointemail.SendEmailInput{
-			ConfigurationSetName: c.setName,
-			FromEmailAddress:     &from,
-			Destination: &pinpointemail.Destination{
-				ToAddresses: allowedRecipients,
-			},
-			Content: &pinpointemail.EmailContent{
-				Raw: &pinpointemail.RawMessage{
-					Data: data,
-				},
+		sendErr := relay.SendBatches(
+			origin,
+			&from,
+			allowedRecipients,
+			maxDestinations,
+			func(batch []*string) error {
+				start := time.Now()
+				_, err := c.pinpointAPI.SendEmail(&pinpointemail.SendEmailInput{
+					ConfigurationSetName: c.setName,
+					FromEmailAddress:     &from,
+					Destination: &pinpointemail.Destination{
+						ToAddresses: batch,
+					},
+					Content: &pinpointemail.EmailContent{
+						Raw: &pinpointemail.RawMessage{
+							Data: data,
+						},
+					},
+					EmailTags:                      tags,
+					FeedbackForwardingEmailAddress: feedbackAddress,
+					ReplyToAddresses:               replyTo,
+				})
+				metrics.APIDuration.Observe(time.Since(start).Seconds(), "pinpoint")
+				return err
 			},
-		})
-		relay.Log(origin, &from, allowedRecipients, err)
-		if err != nil {
-			return err
+		)
+		if sendErr != nil {
+			return sendErr
 		}
 	}
 	return err
 }
 
+// Check verifies the API access via a GetAccount request.
+func (c Client) Check() error {
+	_, err := c.pinpointAPI.GetAccount(&pinpointemail.GetAccountInput{})
+	return err
+}
+
+// MaxSendRate returns the maximum send rate via a GetAccount request.
+func (c Client) MaxSendRate() (float64, error) {
+	out, err := c.pinpointAPI.GetAccount(&pinpointemail.GetAccountInput{})
+	if err != nil || out.SendQuota == nil {
+		return 0, err
+	}
+	return aws.Float64Value(out.SendQuota.MaxSendRate), nil
+}
+
 // New creates a new client with a session.
+// emailTags are sent as message tags, feedbackForwardingAddress as feedback
+// forwarding email address and replyToAddresses as reply-to addresses with
+// every email, unless overridden by the designated headers.
+// configs optionally override the AWS configuration, e.g. the region.
+// Returns an error if the AWS session cannot be created.
 func New(
 	configurationSetName *string,
+	emailTags map[string]string,
+	feedbackForwardingAddress *string,
+	replyToAddresses []string,
 	allowFromRegExp *regexp.Regexp,
 	denyToRegExp *regexp.Regexp,
-) Client {
+	configs ...*aws.Config,
+) (Client, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return Client{}, err
+	}
+	if feedbackForwardingAddress != nil && *feedbackForwardingAddress == "" {
+		feedbackForwardingAddress = nil
+	}
 	return Client{
-		pinpointAPI:     pinpointemail.New(session.Must(session.NewSession())),
+		pinpointAPI:     pinpointemail.New(sess, configs...),
 		setName:         configurationSetName,
+		emailTags:       emailTags,
+		feedbackAddress: feedbackForwardingAddress,
+		replyToAddrs:    replyToAddresses,
 		allowFromRegExp: allowFromRegExp,
 		denyToRegExp:    denyToRegExp,
-	}
+	}, nil
 }
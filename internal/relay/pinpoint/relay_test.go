@@ -6,8 +6,10 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/pinpointemail"
 	"github.com/aws/aws-sdk-go/service/pinpointemail/pinpointemailiface"
 	"github.com/blueimp/aws-smtp-relay/internal/relay"
@@ -35,6 +37,14 @@ func (m *mockPinpointEmailClient) SendEmail(
 	return nil, testData.err
 }
 
+func (m *mockPinpointEmailClient) GetAccount(
+	input *pinpointemail.GetAccountInput,
+) (*pinpointemail.GetAccountOutput, error) {
+	return &pinpointemail.GetAccountOutput{
+		SendQuota: &pinpointemail.SendQuota{MaxSendRate: aws.Float64(14)},
+	}, testData.err
+}
+
 func sendHelper(
 	origin net.Addr,
 	from string,
@@ -250,7 +260,18 @@ func TestNew(t *testing.T) {
 	setName := ""
 	allowFromRegExp, _ := regexp.Compile(`^admin@example\.org$`)
 	denyToRegExp, _ := regexp.Compile(`^bob@example\.org$`)
-	client := New(&setName, allowFromRegExp, denyToRegExp)
+	feedbackAddress := ""
+	client, err := New(
+		&setName,
+		map[string]string{"team": "billing"},
+		&feedbackAddress,
+		[]string{"support@example.org"},
+		allowFromRegExp,
+		denyToRegExp,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
 	_, ok := interface{}(client).(relay.Client)
 	if !ok {
 		t.Error("Unexpected: client is not a relay.Client")
@@ -258,6 +279,15 @@ func TestNew(t *testing.T) {
 	if client.setName != &setName {
 		t.Errorf("Unexpected setName: %s", *client.setName)
 	}
+	if client.emailTags["team"] != "billing" {
+		t.Errorf("Unexpected emailTags: %v", client.emailTags)
+	}
+	if client.feedbackAddress != nil {
+		t.Errorf("Unexpected feedbackAddress: %s", *client.feedbackAddress)
+	}
+	if len(client.replyToAddrs) != 1 {
+		t.Errorf("Unexpected replyToAddrs: %v", client.replyToAddrs)
+	}
 	if client.allowFromRegExp != allowFromRegExp {
 		t.Errorf("Unexpected allowFromRegExp: %s", client.allowFromRegExp)
 	}
@@ -265,3 +295,105 @@ func TestNew(t *testing.T) {
 		t.Errorf("Unexpected denyToRegExp: %s", client.denyToRegExp)
 	}
 }
+
+func TestSendWithPinpointFields(t *testing.T) {
+	feedbackAddress := "bounces@example.org"
+	c := Client{
+		pinpointAPI:     &mockPinpointEmailClient{},
+		emailTags:       map[string]string{"team": "billing", "app": "smtp"},
+		feedbackAddress: &feedbackAddress,
+		replyToAddrs:    []string{"support@example.org"},
+	}
+	originalOut := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() {
+		os.Stdout = originalOut
+		testData.input = nil
+	}()
+	err := c.Send(
+		&net.TCPAddr{},
+		"alice@example.org",
+		[]string{"bob@example.org"},
+		[]byte("Subject: Test\r\nX-Pinpoint-Email-Tags: app=invoice,\r\n campaign=may\r\n"+
+			"x-pinpoint-reply-to-addresses: carol@example.org, dave@example.org\r\n"+
+			"\r\nX-Pinpoint-Email-Tags: body\r\n"),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	input := testData.input
+	expectedData := "Subject: Test\r\n\r\nX-Pinpoint-Email-Tags: body\r\n"
+	if string(input.Content.Raw.Data) != expectedData {
+		t.Errorf("Unexpected data: %q. Expected: %q", input.Content.Raw.Data, expectedData)
+	}
+	var tags []string
+	for _, tag := range input.EmailTags {
+		tags = append(tags, *tag.Name+"="+*tag.Value)
+	}
+	expectedTags := "app=invoice,campaign=may,team=billing"
+	if strings.Join(tags, ",") != expectedTags {
+		t.Errorf("Unexpected email tags: %v. Expected: %s", tags, expectedTags)
+	}
+	if aws.StringValue(input.FeedbackForwardingEmailAddress) != feedbackAddress {
+		t.Errorf(
+			"Unexpected feedback forwarding address: %s. Expected: %s",
+			aws.StringValue(input.FeedbackForwardingEmailAddress),
+			feedbackAddress,
+		)
+	}
+	replyTo := aws.StringValueSlice(input.ReplyToAddresses)
+	if len(replyTo) != 2 || replyTo[0] != "carol@example.org" ||
+		replyTo[1] != "dave@example.org" {
+		t.Errorf("Unexpected reply-to addresses: %v", replyTo)
+	}
+}
+
+func TestSendWithoutPinpointFields(t *testing.T) {
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	data := []byte("Subject: Test\n\nTEST")
+	input, _, _, _ := sendHelper(
+		&origin,
+		"alice@example.org",
+		[]string{"bob@example.org"},
+		data,
+		nil,
+		nil,
+		nil,
+		nil,
+	)
+	if string(input.Content.Raw.Data) != string(data) {
+		t.Errorf("Unexpected data: %q. Expected: %q", input.Content.Raw.Data, data)
+	}
+	if input.EmailTags != nil || input.FeedbackForwardingEmailAddress != nil ||
+		input.ReplyToAddresses != nil {
+		t.Errorf("Unexpected Pinpoint fields: %v", input)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c := Client{pinpointAPI: &mockPinpointEmailClient{}}
+	if err := c.Check(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	testData.err = errors.New("ERROR")
+	defer func() { testData.err = nil }()
+	if err := c.Check(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestMaxSendRate(t *testing.T) {
+	c := Client{pinpointAPI: &mockPinpointEmailClient{}}
+	rate, err := c.MaxSendRate()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if rate != 14 {
+		t.Errorf("Unexpected max send rate: %f. Expected: %d", rate, 14)
+	}
+	testData.err = errors.New("ERROR")
+	defer func() { testData.err = nil }()
+	if _, err := c.MaxSendRate(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+)
+
+// quotaInterval is the duration between send quota updates.
+var quotaInterval = 10 * time.Minute
+
+// limiter implements a token bucket, with tokens representing recipients.
+type limiter struct {
+	mu     sync.Mutex
+	quota  relay.SendQuota
+	next   time.Time
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// Client implements the Relay interface.
+type Client struct {
+	client  relay.Client
+	limiter *limiter
+	maxWait time.Duration
+	now     func() time.Time
+	sleep   func(time.Duration)
+}
+
+// update sets the rate from the send quota, if due.
+// The quota is requested without holding the lock, so only the caller doing
+// the update waits for it, while other callers keep using the previous rate.
+// Errors are logged and the previous rate is kept until the next update.
+func (l *limiter) update(now time.Time) {
+	if l.quota == nil {
+		return
+	}
+	l.mu.Lock()
+	due := !now.Before(l.next)
+	if due {
+		l.next = now.Add(quotaInterval)
+	}
+	l.mu.Unlock()
+	if !due {
+		return
+	}
+	rate, err := l.quota.MaxSendRate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Send quota: "+err.Error())
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate != l.rate {
+		l.rate = rate
+		l.tokens = l.burst()
+	}
+}
+
+// burst returns the bucket capacity, which allows one second worth of sends.
+func (l *limiter) burst() float64 {
+	if l.rate < 1 {
+		return 1
+	}
+	return l.rate
+}
+
+// reserve takes n tokens from the bucket and returns the duration until they
+// are available.
+// If the duration exceeds maxWait, no tokens are taken and false is returned.
+// Reservations exceeding the bucket capacity only wait for a full bucket and
+// leave it with a negative balance, which delays the following reservations,
+// so that emails with more recipients than the rate per second are not always
+// rejected.
+func (l *limiter) reserve(
+	now time.Time,
+	n float64,
+	maxWait time.Duration,
+) (time.Duration, bool) {
+	l.update(now)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0, true
+	}
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if burst := l.burst(); l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+	need := n
+	if burst := l.burst(); need > burst {
+		need = burst
+	}
+	var wait time.Duration
+	if tokens := l.tokens - need; tokens < 0 {
+		wait = time.Duration(-tokens / l.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return 0, false
+	}
+	l.tokens -= n
+	return wait, true
+}
+
+// Send relays the email data via the underlying client, once the send rate
+// allows it.
+// If the email cannot be sent within the maximum wait time, it is rejected
+// with relay.ErrRateLimited.
+func (c Client) Send(
+	origin net.Addr,
+	from string,
+	to []string,
+	data []byte,
+) error {
+	wait, ok := c.limiter.reserve(c.now(), float64(len(to)), c.maxWait)
+	if !ok {
+		relay.Log(origin, &from, relay.Pointers(to), relay.ErrRateLimited)
+		return relay.ErrRateLimited
+	}
+	if wait > 0 {
+		c.sleep(wait)
+	}
+	return c.client.Send(origin, from, to, data)
+}
+
+// Check verifies the API access of the underlying relay client, if supported.
+func (c Client) Check() error {
+	if checker, ok := c.client.(relay.Checker); ok {
+		return checker.Check()
+	}
+	return nil
+}
+
+// New creates a new client, which limits the send rate of the given relay
+// client to rate recipients per second.
+// If rate is 0, the maximum send rate of the client's send quota is used,
+// which is updated every 10 minutes.
+// Emails exceeding the rate are delayed up to maxWait, or rejected with
+// relay.ErrRateLimited if the delay would be longer.
+func New(
+	client relay.Client,
+	rate float64,
+	maxWait time.Duration,
+) Client {
+	l := &limiter{rate: rate}
+	l.tokens = l.burst()
+	if rate == 0 {
+		l.quota, _ = client.(relay.SendQuota)
+	}
+	return Client{
+		client:  client,
+		limiter: l,
+		maxWait: maxWait,
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}
+}
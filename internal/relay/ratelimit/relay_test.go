@@ -0,0 +1,287 @@
+package relay
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+)
+
+type mockClient struct {
+	calls     int
+	rate      float64
+	quotaErr  error
+	quotaHits int
+	err       error
+}
+
+func (m *mockClient) Send(
+	origin net.Addr,
+	from string,
+	to []string,
+	data []byte,
+) error {
+	m.calls++
+	return m.err
+}
+
+func (m *mockClient) Check() error {
+	return m.err
+}
+
+func (m *mockClient) MaxSendRate() (float64, error) {
+	m.quotaHits++
+	return m.rate, m.quotaErr
+}
+
+type mockSender struct {
+	calls int
+}
+
+func (m *mockSender) Send(
+	origin net.Addr,
+	from string,
+	to []string,
+	data []byte,
+) error {
+	m.calls++
+	return nil
+}
+
+func clientHelper(
+	client relay.Client,
+	rate float64,
+	maxWait time.Duration,
+	now *time.Time,
+	slept *time.Duration,
+) Client {
+	c := New(client, rate, maxWait)
+	c.now = func() time.Time { return *now }
+	c.sleep = func(d time.Duration) { *slept += d }
+	return c
+}
+
+func sendHelper(c Client, recipients int) (err error) {
+	origin := &net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	to := make([]string, recipients)
+	for i := range to {
+		to[i] = "bob@example.org"
+	}
+	originalOut := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = originalOut }()
+	return c.Send(origin, "alice@example.org", to, []byte{'T', 'E', 'S', 'T'})
+}
+
+func TestSend(t *testing.T) {
+	mock := &mockClient{}
+	now := time.Now()
+	var slept time.Duration
+	c := clientHelper(mock, 2, 0, &now, &slept)
+	if err := sendHelper(c, 2); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := sendHelper(c, 1); err != relay.ErrRateLimited {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, relay.ErrRateLimited)
+	}
+	if mock.calls != 1 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 1)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if err := sendHelper(c, 1); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if mock.calls != 2 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 2)
+	}
+	if slept != 0 {
+		t.Errorf("Unexpected sleep: %s. Expected: %d", slept, 0)
+	}
+}
+
+func TestSendWithWait(t *testing.T) {
+	mock := &mockClient{}
+	now := time.Now()
+	var slept time.Duration
+	c := clientHelper(mock, 1, 5*time.Second, &now, &slept)
+	if err := sendHelper(c, 1); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := sendHelper(c, 1); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if slept != time.Second {
+		t.Errorf("Unexpected sleep: %s. Expected: %s", slept, time.Second)
+	}
+	// The bucket is full again 2 seconds after the previous reservation, which
+	// leaves it with a balance of -3 after the oversized reservation:
+	if err := sendHelper(c, 4); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if slept != 3*time.Second {
+		t.Errorf("Unexpected sleep: %s. Expected: %s", slept, 3*time.Second)
+	}
+	if err := sendHelper(c, 1); err != relay.ErrRateLimited {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, relay.ErrRateLimited)
+	}
+	if mock.calls != 3 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 2)
+	}
+}
+
+func TestSendWithMoreRecipientsThanRate(t *testing.T) {
+	mock := &mockClient{}
+	now := time.Now()
+	var slept time.Duration
+	c := clientHelper(mock, 14, 0, &now, &slept)
+	if err := sendHelper(c, 15); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := sendHelper(c, 1); err != relay.ErrRateLimited {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, relay.ErrRateLimited)
+	}
+	// The bucket is full again once the negative balance has been refilled:
+	now = now.Add(2 * time.Second)
+	if err := sendHelper(c, 15); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if mock.calls != 2 || slept != 0 {
+		t.Errorf("Unexpected relay calls and sleep: %d, %s", mock.calls, slept)
+	}
+}
+
+func TestSendWithQuota(t *testing.T) {
+	mock := &mockClient{rate: 1}
+	now := time.Now()
+	var slept time.Duration
+	c := clientHelper(mock, 0, 0, &now, &slept)
+	if err := sendHelper(c, 1); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := sendHelper(c, 1); err != relay.ErrRateLimited {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, relay.ErrRateLimited)
+	}
+	if mock.quotaHits != 1 {
+		t.Errorf("Unexpected number of quota requests: %d. Expected: %d", mock.quotaHits, 1)
+	}
+	mock.rate = 10
+	now = now.Add(quotaInterval)
+	if err := sendHelper(c, 10); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if mock.quotaHits != 2 {
+		t.Errorf("Unexpected number of quota requests: %d. Expected: %d", mock.quotaHits, 2)
+	}
+}
+
+func TestSendWithQuotaError(t *testing.T) {
+	mock := &mockClient{quotaErr: errors.New("API failure")}
+	now := time.Now()
+	var slept time.Duration
+	c := clientHelper(mock, 0, 0, &now, &slept)
+	_, errWriter, _ := os.Pipe()
+	originalErr := os.Stderr
+	os.Stderr = errWriter
+	defer func() { os.Stderr = originalErr }()
+	for i := 0; i < 3; i++ {
+		if err := sendHelper(c, 10); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+	if mock.quotaHits != 1 {
+		t.Errorf("Unexpected number of quota requests: %d. Expected: %d", mock.quotaHits, 1)
+	}
+}
+
+type blockingQuota struct {
+	mockSender
+	requested chan struct{}
+	release   chan struct{}
+}
+
+func (b *blockingQuota) MaxSendRate() (float64, error) {
+	close(b.requested)
+	<-b.release
+	return 1, nil
+}
+
+func TestReserveDuringQuotaUpdate(t *testing.T) {
+	quota := &blockingQuota{
+		requested: make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	c := New(quota, 0, 0)
+	now := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.limiter.reserve(now, 1, 0)
+	}()
+	<-quota.requested
+	reserved := make(chan bool)
+	go func() {
+		_, ok := c.limiter.reserve(now, 1, 0)
+		reserved <- ok
+	}()
+	select {
+	case ok := <-reserved:
+		if !ok {
+			t.Error("Unexpected rate limit with the previous rate")
+		}
+	case <-time.After(time.Second):
+		t.Error("Unexpected wait for the send quota update")
+	}
+	close(quota.release)
+	<-done
+	if c.limiter.rate != 1 {
+		t.Errorf("Unexpected rate: %f. Expected: %d", c.limiter.rate, 1)
+	}
+}
+
+func TestSendWithoutQuota(t *testing.T) {
+	mock := &mockSender{}
+	now := time.Now()
+	var slept time.Duration
+	c := clientHelper(mock, 0, 0, &now, &slept)
+	for i := 0; i < 3; i++ {
+		if err := sendHelper(c, 10); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+	if mock.calls != 3 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 3)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c := New(&mockClient{err: errors.New("API failure")}, 1, 0)
+	if err := c.Check(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+	c = New(&mockSender{}, 1, 0)
+	if err := c.Check(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestSendLogsRateLimited(t *testing.T) {
+	mock := &mockClient{}
+	now := time.Now()
+	var slept time.Duration
+	c := clientHelper(mock, 1, 0, &now, &slept)
+	sendHelper(c, 1)
+	outReader, outWriter, _ := os.Pipe()
+	originalOut := os.Stdout
+	os.Stdout = outWriter
+	c.Send(&net.TCPAddr{}, "alice@example.org", []string{"bob@example.org"}, nil)
+	outWriter.Close()
+	os.Stdout = originalOut
+	out, _ := ioutil.ReadAll(outReader)
+	if len(out) == 0 {
+		t.Error("Unexpected empty stdout")
+	}
+}
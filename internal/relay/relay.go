@@ -9,7 +9,13 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strings"
 	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/blueimp/aws-smtp-relay/internal/metrics"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
+	"github.com/blueimp/aws-smtp-relay/internal/smtpd"
 )
 
 var (
@@ -20,8 +26,69 @@ var (
 	ErrDeniedRecipients = errors.New(
 		"denied recipients: recipients match the denied emails regexp",
 	)
+
+	ErrTooManyRecipients = errors.New(
+		"too many recipients: recipients exceed the maximum number per email",
+	)
+
+	ErrExpired = errors.New(
+		"expired: message exceeded the maximum spool age",
+	)
+
+	ErrRateLimited = errors.New(
+		"rate limited: recipients exceed the send rate limit",
+	)
+)
+
+var (
+	replyThrottled = smtpd.Error{
+		Code:    451,
+		Message: "4.4.5 Sending rate exceeded, try again later",
+	}
+	replyUnavailable = smtpd.Error{
+		Code:    451,
+		Message: "4.3.0 Service temporarily unavailable, try again later",
+	}
+	replyPaused = smtpd.Error{
+		Code:    421,
+		Message: "4.3.2 Sending paused, try again later",
+	}
+	replyRejected = smtpd.Error{
+		Code:    554,
+		Message: "5.6.0 Message rejected",
+	}
+	replyNotVerified = smtpd.Error{
+		Code:    550,
+		Message: "5.7.1 Sender not verified",
+	}
+	replyDenied = smtpd.Error{
+		Code:    550,
+		Message: "5.7.1 Requested action not taken",
+	}
+	replyPartial = smtpd.Error{
+		Code:    554,
+		Message: "5.0.0 Message not delivered to some recipients",
+	}
 )
 
+// replies maps SES and Pinpoint API error codes to SMTP replies.
+var replies = map[string]smtpd.Error{
+	"Throttling":                             replyThrottled,
+	"ThrottlingException":                    replyThrottled,
+	"TooManyRequestsException":               replyThrottled,
+	"LimitExceededException":                 replyThrottled,
+	"ServiceUnavailable":                     replyUnavailable,
+	"ServiceUnavailableException":            replyUnavailable,
+	"InternalFailure":                        replyUnavailable,
+	"RequestError":                           replyUnavailable,
+	"AccountSendingPausedException":          replyPaused,
+	"ConfigurationSetSendingPausedException": replyPaused,
+	"SendingPausedException":                 replyPaused,
+	"MessageRejected":                        replyRejected,
+	"MailFromDomainNotVerifiedException":     replyNotVerified,
+	"FromEmailAddressNotVerified":            replyNotVerified,
+}
+
 // Client provides an interface to send emails.
 type Client interface {
 	Send(
@@ -32,23 +99,186 @@ type Client interface {
 	) error
 }
 
+// SendQuota is implemented by clients, which can retrieve the maximum send rate
+// of their account in recipients per second.
+type SendQuota interface {
+	MaxSendRate() (float64, error)
+}
+
+// PartialError is returned if an email could only be sent to some of its
+// recipients, e.g. because one of several API requests failed.
+type PartialError struct {
+	// Recipients holds the recipients which did not receive the email.
+	Recipients []string
+	Err        error
+}
+
+// Error returns the number of failed recipients and the underlying error.
+func (e *PartialError) Error() string {
+	return fmt.Sprintf(
+		"partial failure: %d recipients failed: %s",
+		len(e.Recipients),
+		e.Err,
+	)
+}
+
+// Unwrap returns the underlying error.
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Checker is implemented by clients, which can check their API access.
+type Checker interface {
+	Check() error
+}
+
 type logEntry struct {
-	Time  time.Time
-	IP    *string
-	From  *string
-	To    []*string
-	Error *string
+	Time       time.Time
+	IP         *string
+	User       *string
+	TLSVersion *string
+	TLSCipher  *string
+	From       *string
+	To         []*string
+	Region     *string
+	Error      *string
+}
+
+// outcome returns the result and reason labels of the messages metric for the
+// given error.
+func outcome(err error) (result string, reason string) {
+	var partialErr *PartialError
+	var awsErr awserr.Error
+	switch {
+	case err == nil:
+		return "accepted", ""
+	case err == ErrDeniedSender:
+		return "denied", "denied_sender"
+	case err == ErrDeniedRecipients:
+		return "denied", "denied_recipients"
+	case err == ErrTooManyRecipients:
+		return "denied", "too_many_recipients"
+	case err == ErrExpired:
+		return "failed", "expired"
+	case err == ErrRateLimited:
+		return "failed", "rate_limited"
+	case errors.As(err, &partialErr):
+		return "failed", "partial"
+	case errors.As(err, &awsErr):
+		return "failed", awsErr.Code()
+	}
+	return "failed", "other"
+}
+
+// Temporary reports whether the given error is a temporary API failure, e.g.
+// caused by throttling or an unavailable service, which might not occur with
+// another request or region.
+// ErrRateLimited is also temporary.
+func Temporary(err error) bool {
+	if errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	if reply, ok := replies[awsErr.Code()]; ok {
+		return reply.Code < 500
+	}
+	var requestErr awserr.RequestFailure
+	return errors.As(err, &requestErr) && requestErr.StatusCode() >= 500
+}
+
+// Reply translates the given error into an smtpd.Error with an SMTP reply code
+// and enhanced status code, so clients only retry temporary failures.
+// Denied senders and recipients are rejected permanently.
+// Partial failures are rejected permanently with the number of failed
+// recipients, as a retry would send the email again to the recipients which
+// already received it. The failed recipients are listed in the log entries.
+// Unknown errors are returned unchanged and answered with the default
+// temporary failure reply.
+func Reply(err error) error {
+	var partialErr *PartialError
+	var awsErr awserr.Error
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrRateLimited:
+		return replyThrottled
+	case err == ErrDeniedSender, err == ErrDeniedRecipients,
+		err == ErrTooManyRecipients:
+		reply := replyDenied
+		reply.Message += ": " + err.Error()
+		return reply
+	case errors.As(err, &partialErr):
+		reply := replyPartial
+		reply.Message += fmt.Sprintf(
+			": %d recipients failed",
+			len(partialErr.Recipients),
+		)
+		return reply
+	case errors.As(err, &awsErr):
+		reply, ok := replies[awsErr.Code()]
+		if !ok {
+			return err
+		}
+		// Include the API error message for permanent failures:
+		if reply.Code >= 500 && awsErr.Message() != "" {
+			message := strings.NewReplacer("\r", " ", "\n", " ").
+				Replace(awsErr.Message())
+			reply.Message += ": " + message
+		}
+		return reply
+	}
+	return err
 }
 
 // Log creates a log entry and prints it as JSON to STDOUT.
+// Entries with a sender are counted by outcome in the messages metric.
 func Log(origin net.Addr, from *string, to []*string, err error) {
-	ip := origin.(*net.TCPAddr).IP.String()
+	LogRegion(origin, "", from, to, err)
+}
+
+// LogRegion creates a log entry like Log, which also records the AWS region
+// used to send the email, if not empty.
+func LogRegion(
+	origin net.Addr,
+	region string,
+	from *string,
+	to []*string,
+	err error,
+) {
+	if from != nil {
+		metrics.Messages.Inc(outcome(err))
+	}
+	logRegion(origin, region, from, to, err)
+}
+
+// logRegion prints a log entry without counting it in the messages metric.
+func logRegion(
+	origin net.Addr,
+	region string,
+	from *string,
+	to []*string,
+	err error,
+) {
+	ip := session.IP(origin).String()
 	entry := &logEntry{
 		Time: time.Now().UTC(),
 		IP:   &ip,
 		From: from,
 		To:   to,
 	}
+	if user := session.User(origin); user != "" {
+		entry.User = &user
+	}
+	if version, cipher := session.TLS(origin); version != "" {
+		entry.TLSVersion = &version
+		entry.TLSCipher = &cipher
+	}
+	if region != "" {
+		entry.Region = &region
+	}
 	if err != nil {
 		errString := err.Error()
 		entry.Error = &errString
@@ -57,6 +287,79 @@ func Log(origin net.Addr, from *string, to []*string, err error) {
 	fmt.Println(string(b))
 }
 
+// SendBatches calls send with batches of at most size recipients and logs the
+// result of each batch.
+// The email is counted once in the messages metric, by its overall result.
+// If all batches fail, the first error is returned.
+// If only some of the batches fail, a PartialError with the recipients of the
+// failed batches is returned.
+func SendBatches(
+	origin net.Addr,
+	from *string,
+	recipients []*string,
+	size int,
+	send func(batch []*string) error,
+) error {
+	return SendRegionBatches(
+		origin,
+		from,
+		recipients,
+		size,
+		func(batch []*string) (string, error) {
+			return "", send(batch)
+		},
+	)
+}
+
+// SendRegionBatches works like SendBatches, with send also returning the AWS
+// region used for the batch, which is recorded in the log entry.
+func SendRegionBatches(
+	origin net.Addr,
+	from *string,
+	recipients []*string,
+	size int,
+	send func(batch []*string) (region string, err error),
+) error {
+	var firstErr error
+	var failed []string
+	for start := 0; start < len(recipients); start += size {
+		end := start + size
+		if end > len(recipients) {
+			end = len(recipients)
+		}
+		batch := recipients[start:end]
+		region, err := send(batch)
+		logRegion(origin, region, from, batch, err)
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		for _, recipient := range batch {
+			failed = append(failed, *recipient)
+		}
+	}
+	err := firstErr
+	if firstErr != nil && len(failed) < len(recipients) {
+		err = &PartialError{Recipients: failed, Err: firstErr}
+	}
+	if from != nil {
+		metrics.Messages.Inc(outcome(err))
+	}
+	return err
+}
+
+// Pointers returns pointers to the elements of the given values, e.g. to log
+// the recipients of an email.
+func Pointers(values []string) []*string {
+	pointers := make([]*string, len(values))
+	for k := range values {
+		pointers[k] = &values[k]
+	}
+	return pointers
+}
+
 // FilterAddresses validates sender and recipients and returns lists for allowed
 // and denied recipients.
 // If the sender is denied, all recipients are denied and an error is returned.
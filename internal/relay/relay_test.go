@@ -7,8 +7,14 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/blueimp/aws-smtp-relay/internal/metrics"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
+	"github.com/blueimp/aws-smtp-relay/internal/smtpd"
 )
 
 func pointersToValues(pointers []*string) []string {
@@ -118,6 +124,55 @@ func TestLogWithOriginIPv6(t *testing.T) {
 	}
 }
 
+func TestLogWithUser(t *testing.T) {
+	origin := session.Addr{
+		TCPAddr: net.TCPAddr{IP: []byte{127, 0, 0, 1}},
+		User:    "alice",
+	}
+	from := "alice@example.org"
+	out, err := logHelper(&origin, &from, nil, nil)
+	var entry logEntry
+	json.Unmarshal(out, &entry)
+	if entry.IP == nil || *entry.IP != "127.0.0.1" {
+		t.Errorf("Unexpected 'IP' log: %v. Expected: %s", entry.IP, "127.0.0.1")
+	}
+	if entry.User == nil {
+		t.Errorf("Unexpected 'User' log: %v. Expected: %s", nil, "alice")
+	} else if *entry.User != "alice" {
+		t.Errorf("Unexpected 'User' log: %s. Expected: %s", *entry.User, "alice")
+	}
+	if len(err) != 0 {
+		t.Errorf("Unexpected stderr: %s", err)
+	}
+}
+
+func TestLogWithTLS(t *testing.T) {
+	origin := session.Addr{
+		TCPAddr:    net.TCPAddr{IP: []byte{127, 0, 0, 1}},
+		TLSVersion: "TLS 1.3",
+		TLSCipher:  "TLS_AES_128_GCM_SHA256",
+	}
+	from := "alice@example.org"
+	out, err := logHelper(&origin, &from, nil, nil)
+	var entry logEntry
+	json.Unmarshal(out, &entry)
+	if entry.TLSVersion == nil || *entry.TLSVersion != "TLS 1.3" {
+		t.Errorf("Unexpected 'TLSVersion' log: %v. Expected: %s", entry.TLSVersion, "TLS 1.3")
+	}
+	if entry.TLSCipher == nil || *entry.TLSCipher != "TLS_AES_128_GCM_SHA256" {
+		t.Errorf("Unexpected 'TLSCipher' log: %v", entry.TLSCipher)
+	}
+	if len(err) != 0 {
+		t.Errorf("Unexpected stderr: %s", err)
+	}
+	out, _ = logHelper(&net.TCPAddr{}, &from, nil, nil)
+	entry = logEntry{}
+	json.Unmarshal(out, &entry)
+	if entry.TLSVersion != nil || entry.TLSCipher != nil {
+		t.Errorf("Unexpected TLS log without TLS: %v %v", entry.TLSVersion, entry.TLSCipher)
+	}
+}
+
 func TestLogWithError(t *testing.T) {
 	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
 	emails := []string{
@@ -140,6 +195,217 @@ func TestLogWithError(t *testing.T) {
 	}
 }
 
+func TestOutcome(t *testing.T) {
+	tests := []struct {
+		err    error
+		result string
+		reason string
+	}{
+		{nil, "accepted", ""},
+		{ErrDeniedSender, "denied", "denied_sender"},
+		{ErrDeniedRecipients, "denied", "denied_recipients"},
+		{ErrTooManyRecipients, "denied", "too_many_recipients"},
+		{ErrExpired, "failed", "expired"},
+		{&PartialError{Err: ErrRateLimited}, "failed", "partial"},
+		{awserr.New("Throttling", "Maximum sending rate exceeded.", nil), "failed", "Throttling"},
+		{errors.New("ERROR"), "failed", "other"},
+	}
+	for _, test := range tests {
+		result, reason := outcome(test.err)
+		if result != test.result || reason != test.reason {
+			t.Errorf(
+				"Unexpected outcome: %s/%s. Expected: %s/%s",
+				result,
+				reason,
+				test.result,
+				test.reason,
+			)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	other := errors.New("ERROR")
+	tests := []struct {
+		err   error
+		reply string
+	}{
+		{
+			awserr.New("Throttling", "Maximum sending rate exceeded.", nil),
+			"451 4.4.5 Sending rate exceeded, try again later",
+		},
+		{
+			awserr.New("ServiceUnavailable", "Service unavailable.", nil),
+			"451 4.3.0 Service temporarily unavailable, try again later",
+		},
+		{
+			awserr.New("AccountSendingPausedException", "Sending paused.", nil),
+			"421 4.3.2 Sending paused, try again later",
+		},
+		{
+			awserr.New("MessageRejected", "Email address is not\nverified.", nil),
+			"554 5.6.0 Message rejected: Email address is not verified.",
+		},
+		{
+			awserr.New("MailFromDomainNotVerifiedException", "", nil),
+			"550 5.7.1 Sender not verified",
+		},
+		{
+			ErrDeniedSender,
+			"550 5.7.1 Requested action not taken: " + ErrDeniedSender.Error(),
+		},
+		{
+			&PartialError{
+				Recipients: []string{"c@example.org", "d@example.org"},
+				Err:        awserr.New("Throttling", "Maximum sending rate exceeded.", nil),
+			},
+			"554 5.0.0 Message not delivered to some recipients: " +
+				"2 recipients failed",
+		},
+		{awserr.New("Unknown", "Unknown error.", nil), "Unknown: Unknown error."},
+		{other, other.Error()},
+	}
+	for _, test := range tests {
+		reply := Reply(test.err)
+		if reply.Error() != test.reply {
+			t.Errorf("Unexpected reply: %s. Expected: %s", reply, test.reply)
+		}
+	}
+	var smtpErr smtpd.Error
+	if !errors.As(Reply(ErrDeniedRecipients), &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("Unexpected reply: %v. Expected code: %d", smtpErr, 550)
+	}
+	if Reply(nil) != nil {
+		t.Error("Unexpected non-nil reply for nil error")
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	tests := []struct {
+		err       error
+		temporary bool
+	}{
+		{awserr.New("Throttling", "Maximum sending rate exceeded.", nil), true},
+		{awserr.New("RequestError", "send request failed", nil), true},
+		{awserr.New("AccountSendingPausedException", "Sending paused.", nil), true},
+		{awserr.New("MessageRejected", "Email address is not verified.", nil), false},
+		{
+			awserr.NewRequestFailure(awserr.New("Unknown", "Bad gateway.", nil), 502, ""),
+			true,
+		},
+		{
+			awserr.NewRequestFailure(awserr.New("Unknown", "Bad request.", nil), 400, ""),
+			false,
+		},
+		{ErrDeniedSender, false},
+		{ErrRateLimited, true},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if temporary := Temporary(test.err); temporary != test.temporary {
+			t.Errorf("Unexpected temporary for %v: %t", test.err, temporary)
+		}
+	}
+}
+
+func TestSendBatches(t *testing.T) {
+	origin := &net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	to := []string{"a@example.org", "b@example.org", "c@example.org", "d@example.org", "e@example.org"}
+	var batches [][]*string
+	apiErr := errors.New("API failure")
+	before := metrics.Messages.Value("failed", "partial")
+	beforeAccepted := metrics.Messages.Value("accepted", "")
+	originalOut := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = originalOut }()
+	err := SendBatches(origin, &from, Pointers(to), 2, func(batch []*string) error {
+		batches = append(batches, batch)
+		if len(batches) == 2 {
+			return apiErr
+		}
+		return nil
+	})
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[2]) != 1 {
+		t.Errorf("Unexpected batches: %v", batches)
+	}
+	var partialErr *PartialError
+	if !errors.As(err, &partialErr) {
+		t.Fatalf("Unexpected error: %v. Expected partial error.", err)
+	}
+	if len(partialErr.Recipients) != 2 || partialErr.Recipients[0] != to[2] ||
+		partialErr.Recipients[1] != to[3] {
+		t.Errorf("Unexpected failed recipients: %s", partialErr.Recipients)
+	}
+	if !errors.Is(err, apiErr) {
+		t.Errorf("Unexpected underlying error: %v. Expected: %v", err, apiErr)
+	}
+	if after := metrics.Messages.Value("failed", "partial"); after != before+1 {
+		t.Errorf("Unexpected messages metric: %f. Expected: %f", after, before+1)
+	}
+	if metrics.Messages.Value("accepted", "") != beforeAccepted {
+		t.Error("Unexpected messages metric for successful batches")
+	}
+	err = SendBatches(origin, &from, Pointers(to), 2, func([]*string) error {
+		return apiErr
+	})
+	if err != apiErr {
+		t.Errorf("Unexpected error: %v. Expected: %v", err, apiErr)
+	}
+}
+
+func TestSendRegionBatches(t *testing.T) {
+	origin := &net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	to := []string{"a@example.org", "b@example.org", "c@example.org"}
+	outReader, outWriter, _ := os.Pipe()
+	originalOut := os.Stdout
+	os.Stdout = outWriter
+	err := SendRegionBatches(
+		origin,
+		&from,
+		Pointers(to),
+		2,
+		func(batch []*string) (string, error) {
+			return "eu-west-1", nil
+		},
+	)
+	outWriter.Close()
+	os.Stdout = originalOut
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	out, _ := ioutil.ReadAll(outReader)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected log entries: %s", out)
+	}
+	var entry logEntry
+	json.Unmarshal([]byte(lines[1]), &entry)
+	if entry.Region == nil || *entry.Region != "eu-west-1" {
+		t.Errorf("Unexpected 'Region' log: %v. Expected: %s", entry.Region, "eu-west-1")
+	}
+}
+
+func TestLogWithMetrics(t *testing.T) {
+	origin := &net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	before := metrics.Messages.Value("denied", "denied_sender")
+	beforeOther := metrics.Messages.Value("failed", "other")
+	originalOut := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	Log(origin, &from, nil, ErrDeniedSender)
+	Log(origin, nil, nil, errors.New("Invalid client IP: 127.0.0.1"))
+	os.Stdout = originalOut
+	after := metrics.Messages.Value("denied", "denied_sender")
+	if after != before+1 {
+		t.Errorf("Unexpected messages metric: %f. Expected: %f", after, before+1)
+	}
+	if metrics.Messages.Value("failed", "other") != beforeOther {
+		t.Error("Unexpected messages metric for log entry without sender")
+	}
+}
+
 func TestFilterAddresses(t *testing.T) {
 	from := "alice@example.org"
 	to := []string{
@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
+)
+
+// Route selects the relay client for matching emails.
+// Empty conditions match all emails, all others must match.
+type Route struct {
+	// SenderDomain matches the domain of the sender address.
+	SenderDomain string
+	// User matches the authenticated user.
+	User string
+	// RecipientDomain matches the domain of a recipient address.
+	RecipientDomain string
+	// Headers match the values of the given email headers.
+	Headers map[string]string
+	Client  relay.Client
+}
+
+// Client implements the Relay interface.
+type Client struct {
+	routes  []Route
+	client  relay.Client
+	headers bool
+}
+
+// domain returns the lowercase domain part of the given email address.
+func domain(address string) string {
+	return strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+}
+
+// readHeader parses the header section of the given email data.
+func readHeader(data []byte) textproto.MIMEHeader {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	header, _ := r.ReadMIMEHeader()
+	return header
+}
+
+// match reports whether the route matches the given email and recipient.
+func (r *Route) match(
+	user string,
+	from string,
+	to string,
+	header textproto.MIMEHeader,
+) bool {
+	if r.SenderDomain != "" && !strings.EqualFold(r.SenderDomain, domain(from)) {
+		return false
+	}
+	if r.User != "" && r.User != user {
+		return false
+	}
+	if r.RecipientDomain != "" &&
+		!strings.EqualFold(r.RecipientDomain, domain(to)) {
+		return false
+	}
+	for name, value := range r.Headers {
+		if strings.TrimSpace(header.Get(name)) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// route returns the index of the first route matching the given recipient, or
+// -1 if no route matches.
+func (c Client) route(
+	user string,
+	from string,
+	to string,
+	header textproto.MIMEHeader,
+) int {
+	for i := range c.routes {
+		if c.routes[i].match(user, from, to, header) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Send relays the email data via the client of the first matching route for
+// each recipient, or via the default client if no route matches.
+// If only some of the clients fail, a relay.PartialError with the recipients of
+// the failed clients is returned.
+func (c Client) Send(
+	origin net.Addr,
+	from string,
+	to []string,
+	data []byte,
+) error {
+	var header textproto.MIMEHeader
+	if c.headers {
+		header = readHeader(data)
+	}
+	user := session.User(origin)
+	var order []int
+	groups := make(map[int][]string)
+	for _, recipient := range to {
+		i := c.route(user, from, recipient, header)
+		if _, ok := groups[i]; !ok {
+			order = append(order, i)
+		}
+		groups[i] = append(groups[i], recipient)
+	}
+	if len(order) == 1 {
+		return c.routeClient(order[0]).Send(origin, from, to, data)
+	}
+	var firstErr error
+	var failed []string
+	for _, i := range order {
+		err := c.routeClient(i).Send(origin, from, groups[i], data)
+		if err == nil || err == relay.ErrDeniedRecipients {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		var partialErr *relay.PartialError
+		if errors.As(err, &partialErr) {
+			failed = append(failed, partialErr.Recipients...)
+			continue
+		}
+		failed = append(failed, groups[i]...)
+	}
+	if firstErr == nil || len(failed) == len(to) {
+		return firstErr
+	}
+	return &relay.PartialError{Recipients: failed, Err: firstErr}
+}
+
+// routeClient returns the client of the route with the given index, or the
+// default client for index -1.
+func (c Client) routeClient(i int) relay.Client {
+	if i < 0 {
+		return c.client
+	}
+	return c.routes[i].Client
+}
+
+// Check verifies the API access of the default client, if supported.
+func (c Client) Check() error {
+	if checker, ok := c.client.(relay.Checker); ok {
+		return checker.Check()
+	}
+	return nil
+}
+
+// MaxSendRate returns the maximum send rate of the default client, if
+// supported.
+func (c Client) MaxSendRate() (float64, error) {
+	if quota, ok := c.client.(relay.SendQuota); ok {
+		return quota.MaxSendRate()
+	}
+	return 0, nil
+}
+
+// New creates a new client, which relays emails via the client of the first
+// matching route, or via the given default client if no route matches.
+func New(routes []Route, client relay.Client) Client {
+	c := Client{routes: routes, client: client}
+	for _, route := range routes {
+		if len(route.Headers) > 0 {
+			c.headers = true
+		}
+	}
+	return c
+}
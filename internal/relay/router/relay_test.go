@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
+)
+
+type mockClient struct {
+	to   [][]string
+	rate float64
+	err  error
+}
+
+func (m *mockClient) Send(
+	origin net.Addr,
+	from string,
+	to []string,
+	data []byte,
+) error {
+	m.to = append(m.to, to)
+	return m.err
+}
+
+func (m *mockClient) Check() error {
+	return m.err
+}
+
+func (m *mockClient) MaxSendRate() (float64, error) {
+	return m.rate, m.err
+}
+
+var testData = []byte("X-Route: bulk\r\nSubject: Test\r\n\r\nTEST")
+
+func sendHelper(c Client, user string, from string, to ...string) error {
+	origin := &session.Addr{
+		TCPAddr: net.TCPAddr{IP: []byte{127, 0, 0, 1}},
+		User:    user,
+	}
+	return c.Send(origin, from, to, testData)
+}
+
+func TestSendWithSenderDomain(t *testing.T) {
+	routed := &mockClient{}
+	fallback := &mockClient{}
+	c := New([]Route{{SenderDomain: "Example.org", Client: routed}}, fallback)
+	if err := sendHelper(c, "", "alice@example.org", "bob@example.net"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := sendHelper(c, "", "alice@example.net", "bob@example.net"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if len(routed.to) != 1 || len(fallback.to) != 1 {
+		t.Errorf("Unexpected calls: %v, %v", routed.to, fallback.to)
+	}
+}
+
+func TestSendWithUser(t *testing.T) {
+	routed := &mockClient{}
+	fallback := &mockClient{}
+	c := New([]Route{{User: "alice", Client: routed}}, fallback)
+	if err := sendHelper(c, "alice", "alice@example.org", "bob@example.org"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := sendHelper(c, "", "alice@example.org", "bob@example.org"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if len(routed.to) != 1 || len(fallback.to) != 1 {
+		t.Errorf("Unexpected calls: %v, %v", routed.to, fallback.to)
+	}
+}
+
+func TestSendWithHeaders(t *testing.T) {
+	routed := &mockClient{}
+	fallback := &mockClient{}
+	c := New([]Route{
+		{Headers: map[string]string{"x-route": "transactional"}, Client: fallback},
+		{Headers: map[string]string{"x-route": "bulk"}, Client: routed},
+	}, fallback)
+	if err := sendHelper(c, "", "alice@example.org", "bob@example.org"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if len(routed.to) != 1 || len(fallback.to) != 0 {
+		t.Errorf("Unexpected calls: %v, %v", routed.to, fallback.to)
+	}
+}
+
+func TestSendWithRecipientDomain(t *testing.T) {
+	routed := &mockClient{}
+	fallback := &mockClient{}
+	c := New([]Route{{RecipientDomain: "example.net", Client: routed}}, fallback)
+	err := sendHelper(
+		c,
+		"",
+		"alice@example.org",
+		"bob@example.org",
+		"carol@example.net",
+		"dave@example.org",
+	)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	expected := [][]string{{"carol@example.net"}}
+	if !reflect.DeepEqual(routed.to, expected) {
+		t.Errorf("Unexpected routed recipients: %v. Expected: %v", routed.to, expected)
+	}
+	expected = [][]string{{"bob@example.org", "dave@example.org"}}
+	if !reflect.DeepEqual(fallback.to, expected) {
+		t.Errorf("Unexpected default recipients: %v. Expected: %v", fallback.to, expected)
+	}
+}
+
+func TestSendWithPartialError(t *testing.T) {
+	apiErr := errors.New("API failure")
+	routed := &mockClient{err: apiErr}
+	fallback := &mockClient{}
+	c := New([]Route{{RecipientDomain: "example.net", Client: routed}}, fallback)
+	err := sendHelper(c, "", "alice@example.org", "bob@example.org", "carol@example.net")
+	var partialErr *relay.PartialError
+	if !errors.As(err, &partialErr) {
+		t.Fatalf("Unexpected error: %v. Expected a relay.PartialError", err)
+	}
+	if !reflect.DeepEqual(partialErr.Recipients, []string{"carol@example.net"}) {
+		t.Errorf("Unexpected failed recipients: %v", partialErr.Recipients)
+	}
+	if partialErr.Err != apiErr {
+		t.Errorf("Unexpected error: %v. Expected: %s", partialErr.Err, apiErr)
+	}
+	fallback.err = apiErr
+	err = sendHelper(c, "", "alice@example.org", "bob@example.org", "carol@example.net")
+	if err != apiErr {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, apiErr)
+	}
+	fallback.err = relay.ErrDeniedRecipients
+	routed.err = nil
+	err = sendHelper(c, "", "alice@example.org", "bob@example.org", "carol@example.net")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c := New(nil, &mockClient{err: errors.New("API failure")})
+	if err := c.Check(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestMaxSendRate(t *testing.T) {
+	c := New(nil, &mockClient{rate: 14})
+	rate, err := c.MaxSendRate()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if rate != 14 {
+		t.Errorf("Unexpected max send rate: %f. Expected: %d", rate, 14)
+	}
+}
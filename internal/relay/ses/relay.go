@@ -1,23 +1,125 @@
 package relay
 
 import (
+	"fmt"
 	"net"
+	"os"
 	"regexp"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+	"github.com/blueimp/aws-smtp-relay/internal/metrics"
 	"github.com/blueimp/aws-smtp-relay/internal/relay"
 )
 
+// maxDestinations is the maximum number of recipients per API request.
+const maxDestinations = 50
+
+// failureThreshold is the number of consecutive failures, which open the
+// circuit of a region.
+var failureThreshold = 3
+
+// probeInterval is the duration after which a region with an open circuit is
+// probed again.
+var probeInterval = time.Minute
+
+// region holds the SES API client and circuit breaker state of an AWS region.
+type region struct {
+	name     string
+	sesAPI   sesiface.SESAPI
+	failures int
+	probe    time.Time
+}
+
+// regions holds the AWS regions in failover order.
+type regions struct {
+	mu   sync.Mutex
+	list []*region
+	now  func() time.Time
+}
+
 // Client implements the Relay interface.
 type Client struct {
-	sesAPI          sesiface.SESAPI
+	regions         *regions
 	setName         *string
 	allowFromRegExp *regexp.Regexp
 	denyToRegExp    *regexp.Regexp
 }
 
+// available reports whether the circuit of the region allows a request.
+// Once the probe interval of an open circuit has passed, a single request is
+// allowed to probe the region.
+func (r *regions) available(reg *region, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reg.failures < failureThreshold {
+		return true
+	}
+	if now.Before(reg.probe) {
+		return false
+	}
+	reg.probe = now.Add(probeInterval)
+	return true
+}
+
+// record updates the circuit of the region with the result of a request.
+// Only temporary errors count as failures, as other errors are not caused by
+// the region.
+func (r *regions) record(reg *region, now time.Time, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !relay.Temporary(err) {
+		if reg.failures >= failureThreshold {
+			fmt.Fprintln(os.Stderr, "Region "+reg.name+": circuit closed")
+		}
+		reg.failures = 0
+		return
+	}
+	reg.failures++
+	if reg.failures == failureThreshold {
+		fmt.Fprintln(os.Stderr, "Region "+reg.name+": circuit open")
+	}
+	if reg.failures >= failureThreshold {
+		reg.probe = now.Add(probeInterval)
+	}
+}
+
+// call calls fn with the SES API client of the first available region and
+// fails over to the next region on temporary errors.
+// If no region is available, the first region is used.
+// It returns the name of the last region called and its error.
+func (r *regions) call(fn func(sesAPI sesiface.SESAPI) error) (string, error) {
+	var name string
+	var err error
+	called := false
+	for _, reg := range r.list {
+		if !r.available(reg, r.now()) {
+			continue
+		}
+		if called {
+			fmt.Fprintln(
+				os.Stderr,
+				"Region "+name+": failover to "+reg.name+": "+err.Error(),
+			)
+		}
+		name, err, called = reg.name, fn(reg.sesAPI), true
+		r.record(reg, r.now(), err)
+		if !relay.Temporary(err) {
+			return name, err
+		}
+	}
+	if !called {
+		reg := r.list[0]
+		name, err = reg.name, fn(reg.sesAPI)
+		r.record(reg, r.now(), err)
+	}
+	return name, err
+}
+
 // Send uses the client SESAPI to send email data
 func (c Client) Send(
 	origin net.Addr,
@@ -35,30 +137,91 @@ func (c Client) Send(
 		relay.Log(origin, &from, deniedRecipients, err)
 	}
 	if len(allowedRecipients) > 0 {
-		_, err := c.sesAPI.SendRawEmail(&ses.SendRawEmailInput{
-			ConfigurationSetName: c.setName,
-			Source:               &from,
-			Destinations:         allowedRecipients,
-			RawMessage:           &ses.RawMessage{Data: data},
-		})
-		relay.Log(origin, &from, allowedRecipients, err)
-		if err != nil {
-			return err
+		sendErr := relay.SendRegionBatches(
+			origin,
+			&from,
+			allowedRecipients,
+			maxDestinations,
+			func(batch []*string) (string, error) {
+				return c.regions.call(func(sesAPI sesiface.SESAPI) error {
+					start := time.Now()
+					_, err := sesAPI.SendRawEmail(&ses.SendRawEmailInput{
+						ConfigurationSetName: c.setName,
+						Source:               &from,
+						Destinations:         batch,
+						RawMessage:           &ses.RawMessage{Data: data},
+					})
+					metrics.APIDuration.Observe(time.Since(start).Seconds(), "ses")
+					return err
+				})
+			},
+		)
+		if sendErr != nil {
+			return sendErr
 		}
 	}
 	return err
 }
 
+// Check verifies the API access via a GetSendQuota request to the first
+// available region.
+func (c Client) Check() error {
+	_, err := c.regions.call(func(sesAPI sesiface.SESAPI) error {
+		_, err := sesAPI.GetSendQuota(&ses.GetSendQuotaInput{})
+		return err
+	})
+	return err
+}
+
+// MaxSendRate returns the maximum send rate via a GetSendQuota request to the
+// first available region.
+func (c Client) MaxSendRate() (float64, error) {
+	var out *ses.GetSendQuotaOutput
+	_, err := c.regions.call(func(sesAPI sesiface.SESAPI) (err error) {
+		out, err = sesAPI.GetSendQuota(&ses.GetSendQuotaInput{})
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+	return aws.Float64Value(out.MaxSendRate), nil
+}
+
 // New creates a new client with a session.
+// regionNames optionally lists the AWS regions in failover order, with the
+// first region as primary, which is used again once it is available.
+// configs optionally override the AWS configuration, e.g. the region.
+// Returns an error if the AWS session cannot be created.
 func New(
 	configurationSetName *string,
 	allowFromRegExp *regexp.Regexp,
 	denyToRegExp *regexp.Regexp,
-) Client {
+	regionNames []string,
+	configs ...*aws.Config,
+) (Client, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return Client{}, err
+	}
+	r := &regions{now: time.Now}
+	for _, name := range regionNames {
+		regionConfigs := append(configs, aws.NewConfig().WithRegion(name))
+		r.list = append(r.list, &region{
+			name:   name,
+			sesAPI: ses.New(sess, regionConfigs...),
+		})
+	}
+	if len(r.list) == 0 {
+		sesAPI := ses.New(sess, configs...)
+		r.list = []*region{{
+			name:   aws.StringValue(sesAPI.Config.Region),
+			sesAPI: sesAPI,
+		}}
+	}
 	return Client{
-		sesAPI:          ses.New(session.Must(session.NewSession())),
+		regions:         r,
 		setName:         configurationSetName,
 		allowFromRegExp: allowFromRegExp,
 		denyToRegExp:    denyToRegExp,
-	}
+	}, nil
 }
@@ -1,13 +1,18 @@
 package relay
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"regexp"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/aws/aws-sdk-go/service/ses/sesiface"
 	"github.com/blueimp/aws-smtp-relay/internal/relay"
@@ -15,6 +20,7 @@ import (
 
 var testData = struct {
 	input *ses.SendRawEmailInput
+	calls int
 	err   error
 }{}
 
@@ -27,9 +33,42 @@ func (m *mockSESAPI) SendRawEmail(input *ses.SendRawEmailInput) (
 	error,
 ) {
 	testData.input = input
+	testData.calls++
 	return nil, testData.err
 }
 
+func (m *mockSESAPI) GetSendQuota(input *ses.GetSendQuotaInput) (
+	*ses.GetSendQuotaOutput,
+	error,
+) {
+	return &ses.GetSendQuotaOutput{MaxSendRate: aws.Float64(14)}, testData.err
+}
+
+type mockRegionAPI struct {
+	sesiface.SESAPI
+	calls int
+	err   error
+}
+
+func (m *mockRegionAPI) SendRawEmail(input *ses.SendRawEmailInput) (
+	*ses.SendRawEmailOutput,
+	error,
+) {
+	m.calls++
+	return nil, m.err
+}
+
+func regionsHelper(apis ...sesiface.SESAPI) *regions {
+	r := &regions{now: time.Now}
+	for i, api := range apis {
+		r.list = append(r.list, &region{
+			name:   fmt.Sprintf("region-%d", i+1),
+			sesAPI: api,
+		})
+	}
+	return r
+}
+
 func sendHelper(
 	origin net.Addr,
 	from string,
@@ -54,11 +93,12 @@ func sendHelper(
 	os.Stderr = errWriter
 	func() {
 		c := Client{
-			sesAPI:          &mockSESAPI{},
+			regions:         regionsHelper(&mockSESAPI{}),
 			setName:         configurationSetName,
 			allowFromRegExp: allowFromRegExp,
 			denyToRegExp:    denyToRegExp,
 		}
+		testData.calls = 0
 		testData.err = apiErr
 		sendErr = c.Send(origin, from, to, data)
 		outWriter.Close()
@@ -138,6 +178,38 @@ func TestSendWithMultipleRecipients(t *testing.T) {
 	}
 }
 
+func TestSendWithBatches(t *testing.T) {
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	to := make([]string, 2*maxDestinations+20)
+	for i := range to {
+		to[i] = fmt.Sprintf("user%d@example.org", i)
+	}
+	data := []byte{'T', 'E', 'S', 'T'}
+	setName := ""
+	input, _, _, sendErr := sendHelper(&origin, from, to, data, &setName, nil, nil, nil)
+	if sendErr != nil {
+		t.Errorf("Unexpected error: %s", sendErr)
+	}
+	if testData.calls != 3 {
+		t.Errorf("Unexpected number of API calls: %d. Expected: %d", testData.calls, 3)
+	}
+	if len(input.Destinations) != 20 {
+		t.Errorf(
+			"Unexpected number of destinations: %d. Expected: %d",
+			len(input.Destinations),
+			20,
+		)
+	}
+	if *input.Destinations[0] != to[2*maxDestinations] {
+		t.Errorf(
+			"Unexpected destination: %s. Expected: %s",
+			*input.Destinations[0],
+			to[2*maxDestinations],
+		)
+	}
+}
+
 func TestSendWithDeniedSender(t *testing.T) {
 	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
 	from := "alice@example.org"
@@ -245,7 +317,10 @@ func TestNew(t *testing.T) {
 	setName := ""
 	allowFromRegExp, _ := regexp.Compile(`^admin@example\.org$`)
 	denyToRegExp, _ := regexp.Compile(`^bob@example\.org$`)
-	client := New(&setName, allowFromRegExp, denyToRegExp)
+	client, err := New(&setName, allowFromRegExp, denyToRegExp, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
 	_, ok := interface{}(client).(relay.Client)
 	if !ok {
 		t.Error("Unexpected: client is not a relay.Client")
@@ -260,3 +335,147 @@ func TestNew(t *testing.T) {
 		t.Errorf("Unexpected denyToRegExp: %s", client.denyToRegExp)
 	}
 }
+
+func TestCheck(t *testing.T) {
+	c := Client{regions: regionsHelper(&mockSESAPI{})}
+	if err := c.Check(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	testData.err = errors.New("ERROR")
+	defer func() { testData.err = nil }()
+	if err := c.Check(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestMaxSendRate(t *testing.T) {
+	c := Client{regions: regionsHelper(&mockSESAPI{})}
+	rate, err := c.MaxSendRate()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if rate != 14 {
+		t.Errorf("Unexpected max send rate: %f. Expected: %d", rate, 14)
+	}
+	testData.err = errors.New("ERROR")
+	defer func() { testData.err = nil }()
+	if _, err := c.MaxSendRate(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func failoverHelper(c Client) (entry map[string]interface{}, sendErr error) {
+	origin := &net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	outReader, outWriter, _ := os.Pipe()
+	originalOut := os.Stdout
+	originalErr := os.Stderr
+	os.Stdout = outWriter
+	os.Stderr, _ = os.Open(os.DevNull)
+	sendErr = c.Send(origin, "alice@example.org", []string{"bob@example.org"}, nil)
+	outWriter.Close()
+	os.Stdout = originalOut
+	os.Stderr = originalErr
+	out, _ := ioutil.ReadAll(outReader)
+	json.Unmarshal(out, &entry)
+	return
+}
+
+func TestSendWithFailover(t *testing.T) {
+	primary := &mockRegionAPI{err: awserr.New("Throttling", "Rate exceeded.", nil)}
+	secondary := &mockRegionAPI{}
+	c := Client{regions: regionsHelper(primary, secondary)}
+	entry, err := failoverHelper(c)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if entry["Region"] != "region-2" {
+		t.Errorf("Unexpected 'Region' log: %v. Expected: %s", entry["Region"], "region-2")
+	}
+	if primary.calls != 1 || secondary.calls != 1 {
+		t.Errorf("Unexpected calls: %d, %d. Expected: 1, 1", primary.calls, secondary.calls)
+	}
+	primary.err = awserr.New("MessageRejected", "Email address is not verified.", nil)
+	entry, err = failoverHelper(c)
+	if err != primary.err {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, primary.err)
+	}
+	if entry["Region"] != "region-1" {
+		t.Errorf("Unexpected 'Region' log: %v. Expected: %s", entry["Region"], "region-1")
+	}
+	if secondary.calls != 1 {
+		t.Errorf("Unexpected secondary calls: %d. Expected: %d", secondary.calls, 1)
+	}
+}
+
+func TestSendWithCircuitBreaker(t *testing.T) {
+	primary := &mockRegionAPI{err: awserr.New("ServiceUnavailable", "", nil)}
+	secondary := &mockRegionAPI{}
+	c := Client{regions: regionsHelper(primary, secondary)}
+	now := time.Now()
+	c.regions.now = func() time.Time { return now }
+	for i := 0; i < failureThreshold+2; i++ {
+		if _, err := failoverHelper(c); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+	if primary.calls != failureThreshold {
+		t.Errorf("Unexpected primary calls: %d. Expected: %d", primary.calls, failureThreshold)
+	}
+	// Probe the primary region, which still fails:
+	now = now.Add(probeInterval)
+	failoverHelper(c)
+	failoverHelper(c)
+	if primary.calls != failureThreshold+1 {
+		t.Errorf("Unexpected primary calls: %d. Expected: %d", primary.calls, failureThreshold+1)
+	}
+	// Fail back once the primary region has recovered:
+	primary.err = nil
+	now = now.Add(probeInterval)
+	for i := 0; i < 2; i++ {
+		entry, err := failoverHelper(c)
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if entry["Region"] != "region-1" {
+			t.Errorf("Unexpected 'Region' log: %v. Expected: %s", entry["Region"], "region-1")
+		}
+	}
+	if secondary.calls != failureThreshold+4 {
+		t.Errorf("Unexpected secondary calls: %d. Expected: %d", secondary.calls, failureThreshold+4)
+	}
+}
+
+func TestSendWithUnavailableRegions(t *testing.T) {
+	apiErr := awserr.New("InternalFailure", "", nil)
+	primary := &mockRegionAPI{err: apiErr}
+	secondary := &mockRegionAPI{err: apiErr}
+	c := Client{regions: regionsHelper(primary, secondary)}
+	for i := 0; i < failureThreshold+1; i++ {
+		if _, err := failoverHelper(c); err != apiErr {
+			t.Errorf("Unexpected error: %v. Expected: %s", err, apiErr)
+		}
+	}
+	if primary.calls != failureThreshold+1 || secondary.calls != failureThreshold {
+		t.Errorf("Unexpected calls: %d, %d", primary.calls, secondary.calls)
+	}
+}
+
+func TestNewWithRegions(t *testing.T) {
+	client, err := New(nil, nil, nil, []string{"us-east-1", "us-west-2"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(client.regions.list) != 2 {
+		t.Fatalf("Unexpected regions: %d. Expected: %d", len(client.regions.list), 2)
+	}
+	for i, name := range []string{"us-east-1", "us-west-2"} {
+		r := client.regions.list[i]
+		if r.name != name {
+			t.Errorf("Unexpected region name: %s. Expected: %s", r.name, name)
+		}
+		region := aws.StringValue(r.sesAPI.(*ses.SES).Config.Region)
+		if region != name {
+			t.Errorf("Unexpected region config: %s. Expected: %s", region, name)
+		}
+	}
+}
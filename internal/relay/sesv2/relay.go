@@ -0,0 +1,150 @@
+package relay
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sesv2"
+	"github.com/aws/aws-sdk-go/service/sesv2/sesv2iface"
+	"github.com/blueimp/aws-smtp-relay/internal/metrics"
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+)
+
+// maxDestinations is the maximum number of recipients per API request.
+const maxDestinations = 50
+
+// Client implements the Relay interface.
+type Client struct {
+	sesv2API              sesv2iface.SESV2API
+	setName               *string
+	identityArn           *string
+	emailTags             []*sesv2.MessageTag
+	listManagementOptions *sesv2.ListManagementOptions
+	allowFromRegExp       *regexp.Regexp
+	denyToRegExp          *regexp.Regexp
+}
+
+// Send uses the client SESV2API to send email data
+func (c Client) Send(
+	origin net.Addr,
+	from string,
+	to []string,
+	data []byte,
+) error {
+	allowedRecipients, deniedRecipients, err := relay.FilterAddresses(
+		from,
+		to,
+		c.allowFromRegExp,
+		c.denyToRegExp,
+	)
+	if err != nil {
+		relay.Log(origin, &from, deniedRecipients, err)
+	}
+	if len(allowedRecipients) > 0 {
+		sendErr := relay.SendBatches(
+			origin,
+			&from,
+			allowedRecipients,
+			maxDestinations,
+			func(batch []*string) error {
+				start := time.Now()
+				_, err := c.sesv2API.SendEmail(&sesv2.SendEmailInput{
+					ConfigurationSetName:        optional(c.setName),
+					FromEmailAddress:            &from,
+					FromEmailAddressIdentityArn: optional(c.identityArn),
+					Destination: &sesv2.Destination{
+						ToAddresses: batch,
+					},
+					Content: &sesv2.EmailContent{
+						Raw: &sesv2.RawMessage{
+							Data: data,
+						},
+					},
+					EmailTags:             c.emailTags,
+					ListManagementOptions: c.listManagementOptions,
+				})
+				metrics.APIDuration.Observe(time.Since(start).Seconds(), "sesv2")
+				return err
+			},
+		)
+		if sendErr != nil {
+			return sendErr
+		}
+	}
+	return err
+}
+
+// Check verifies the API access via a GetAccount request.
+func (c Client) Check() error {
+	_, err := c.sesv2API.GetAccount(&sesv2.GetAccountInput{})
+	return err
+}
+
+// optional returns nil for empty strings, which are rejected by the API.
+func optional(s *string) *string {
+	if s == nil || *s == "" {
+		return nil
+	}
+	return s
+}
+
+// MaxSendRate returns the maximum send rate via a GetAccount request.
+func (c Client) MaxSendRate() (float64, error) {
+	out, err := c.sesv2API.GetAccount(&sesv2.GetAccountInput{})
+	if err != nil || out.SendQuota == nil {
+		return 0, err
+	}
+	return aws.Float64Value(out.SendQuota.MaxSendRate), nil
+}
+
+// New creates a new client with a session.
+// emailTags are sent as message tags with every email.
+// If contactListName is not empty, list management options are set, with
+// topicName being optional.
+// configs optionally override the AWS configuration, e.g. the region.
+// Returns an error if the AWS session cannot be created.
+func New(
+	configurationSetName *string,
+	fromEmailAddressIdentityArn *string,
+	emailTags map[string]string,
+	contactListName *string,
+	topicName *string,
+	allowFromRegExp *regexp.Regexp,
+	denyToRegExp *regexp.Regexp,
+	configs ...*aws.Config,
+) (Client, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return Client{}, err
+	}
+	var tags []*sesv2.MessageTag
+	names := make([]string, 0, len(emailTags))
+	for name := range emailTags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for k := range names {
+		value := emailTags[names[k]]
+		tags = append(tags, &sesv2.MessageTag{Name: &names[k], Value: &value})
+	}
+	var listManagementOptions *sesv2.ListManagementOptions
+	if optional(contactListName) != nil {
+		listManagementOptions = &sesv2.ListManagementOptions{
+			ContactListName: contactListName,
+			TopicName:       optional(topicName),
+		}
+	}
+	return Client{
+		sesv2API:              sesv2.New(sess, configs...),
+		setName:               configurationSetName,
+		identityArn:           fromEmailAddressIdentityArn,
+		emailTags:             tags,
+		listManagementOptions: listManagementOptions,
+		allowFromRegExp:       allowFromRegExp,
+		denyToRegExp:          denyToRegExp,
+	}, nil
+}
@@ -0,0 +1,423 @@
+package relay
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sesv2"
+	"github.com/aws/aws-sdk-go/service/sesv2/sesv2iface"
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+)
+
+var testData = struct {
+	input *sesv2.SendEmailInput
+	err   error
+}{}
+
+type mockSESV2API struct {
+	sesv2iface.SESV2API
+}
+
+func (m *mockSESV2API) SendEmail(input *sesv2.SendEmailInput) (
+	*sesv2.SendEmailOutput,
+	error,
+) {
+	testData.input = input
+	return nil, testData.err
+}
+
+func (m *mockSESV2API) GetAccount(input *sesv2.GetAccountInput) (
+	*sesv2.GetAccountOutput,
+	error,
+) {
+	return &sesv2.GetAccountOutput{
+		SendQuota: &sesv2.SendQuota{MaxSendRate: aws.Float64(14)},
+	}, testData.err
+}
+
+func sendHelper(
+	origin net.Addr,
+	from string,
+	to []string,
+	data []byte,
+	configurationSetName *string,
+	allowFromRegExp *regexp.Regexp,
+	denyToRegExp *regexp.Regexp,
+	apiErr error,
+) (email *sesv2.SendEmailInput, out []byte, err []byte, sendErr error) {
+	outReader, outWriter, _ := os.Pipe()
+	errReader, errWriter, _ := os.Pipe()
+	originalOut := os.Stdout
+	originalErr := os.Stderr
+	defer func() {
+		testData.input = nil
+		testData.err = nil
+		os.Stdout = originalOut
+		os.Stderr = originalErr
+	}()
+	os.Stdout = outWriter
+	os.Stderr = errWriter
+	func() {
+		c := Client{
+			sesv2API:        &mockSESV2API{},
+			setName:         configurationSetName,
+			allowFromRegExp: allowFromRegExp,
+			denyToRegExp:    denyToRegExp,
+		}
+		testData.err = apiErr
+		sendErr = c.Send(origin, from, to, data)
+		outWriter.Close()
+		errWriter.Close()
+	}()
+	stdout, _ := ioutil.ReadAll(outReader)
+	stderr, _ := ioutil.ReadAll(errReader)
+	return testData.input, stdout, stderr, sendErr
+}
+
+func TestSend(t *testing.T) {
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	to := []string{"bob@example.org"}
+	data := []byte{'T', 'E', 'S', 'T'}
+	setName := ""
+	input, out, err, _ := sendHelper(&origin, from, to, data, &setName, nil, nil, nil)
+	if *input.FromEmailAddress != from {
+		t.Errorf(
+			"Unexpected source: %s. Expected: %s",
+			*input.FromEmailAddress,
+			from,
+		)
+	}
+	if len(input.Destination.ToAddresses) != 1 {
+		t.Errorf(
+			"Unexpected number of destinations: %d. Expected: %d",
+			len(input.Destination.ToAddresses),
+			1,
+		)
+	}
+	if *input.Destination.ToAddresses[0] != to[0] {
+		t.Errorf(
+			"Unexpected destination: %s. Expected: %s",
+			*input.Destination.ToAddresses[0],
+			to[0],
+		)
+	}
+	inputData := string(input.Content.Raw.Data)
+	if inputData != "TEST" {
+		t.Errorf("Unexpected data: %s. Expected: %s", inputData, "TEST")
+	}
+	if len(out) == 0 {
+		t.Error("Unexpected empty stdout")
+	}
+	if len(err) != 0 {
+		t.Errorf("Unexpected stderr: %s", err)
+	}
+}
+
+func TestSendWithMultipleRecipients(t *testing.T) {
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	to := []string{"bob@example.org", "charlie@example.org"}
+	data := []byte{'T', 'E', 'S', 'T'}
+	setName := ""
+	input, out, err, _ := sendHelper(&origin, from, to, data, &setName, nil, nil, nil)
+	if len(input.Destination.ToAddresses) != 2 {
+		t.Errorf(
+			"Unexpected number of destinations: %d. Expected: %d",
+			len(input.Destination.ToAddresses),
+			2,
+		)
+	}
+	if *input.Destination.ToAddresses[0] != to[0] {
+		t.Errorf(
+			"Unexpected destination: %s. Expected: %s",
+			*input.Destination.ToAddresses[0],
+			to[0],
+		)
+	}
+	if len(out) == 0 {
+		t.Error("Unexpected empty stdout")
+	}
+	if len(err) != 0 {
+		t.Errorf("Unexpected stderr: %s", err)
+	}
+}
+
+func TestSendWithDeniedSender(t *testing.T) {
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	to := []string{"bob@example.org", "charlie@example.org"}
+	data := []byte{'T', 'E', 'S', 'T'}
+	setName := ""
+	regexp, _ := regexp.Compile(`^admin@example\.org$`)
+	input, out, err, sendErr := sendHelper(&origin, from, to, data, &setName, regexp, nil, nil)
+	if input != nil {
+		t.Errorf(
+			"Unexpected number of destinations: %d. Expected: %d",
+			len(input.Destination.ToAddresses),
+			0,
+		)
+	}
+	if sendErr != relay.ErrDeniedSender {
+		t.Errorf("Unexpected error: %s. Expected: %s", sendErr, relay.ErrDeniedSender)
+	}
+	if len(out) == 0 {
+		t.Error("Unexpected empty stdout")
+	}
+	if len(err) != 0 {
+		t.Errorf("Unexpected stderr: %s", err)
+	}
+}
+
+func TestSendWithDeniedRecipient(t *testing.T) {
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	to := []string{"bob@example.org", "charlie@example.org"}
+	data := []byte{'T', 'E', 'S', 'T'}
+	setName := ""
+	regexp, _ := regexp.Compile(`^bob@example\.org$`)
+	input, out, err, sendErr := sendHelper(&origin, from, to, data, &setName, nil, regexp, nil)
+	if len(input.Destination.ToAddresses) != 1 {
+		t.Errorf(
+			"Unexpected number of destinations: %d. Expected: %d",
+			len(input.Destination.ToAddresses),
+			1,
+		)
+	}
+	if *input.Destination.ToAddresses[0] != to[1] {
+		t.Errorf(
+			"Unexpected destination: %s. Expected: %s",
+			*input.Destination.ToAddresses[0],
+			to[1],
+		)
+	}
+	if sendErr != relay.ErrDeniedRecipients {
+		t.Errorf("Unexpected error: %s. Expected: %s", sendErr, relay.ErrDeniedRecipients)
+	}
+	if len(out) == 0 {
+		t.Error("Unexpected empty stdout")
+	}
+	if len(err) != 0 {
+		t.Errorf("Unexpected stderr: %s", err)
+	}
+}
+
+func TestSendWithApiError(t *testing.T) {
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	to := []string{"bob@example.org"}
+	data := []byte{'T', 'E', 'S', 'T'}
+	setName := ""
+	apiErr := errors.New("API failure")
+	input, out, err, sendErr := sendHelper(&origin, from, to, data, &setName, nil, nil, apiErr)
+	if *input.FromEmailAddress != from {
+		t.Errorf(
+			"Unexpected source: %s. Expected: %s",
+			*input.FromEmailAddress,
+			from,
+		)
+	}
+	if len(input.Destination.ToAddresses) != 1 {
+		t.Errorf(
+			"Unexpected number of destinations: %d. Expected: %d",
+			len(input.Destination.ToAddresses),
+			1,
+		)
+	}
+	if *input.Destination.ToAddresses[0] != to[0] {
+		t.Errorf(
+			"Unexpected destination: %s. Expected: %s",
+			*input.Destination.ToAddresses[0],
+			to[0],
+		)
+	}
+	inputData := string(input.Content.Raw.Data)
+	if inputData != "TEST" {
+		t.Errorf("Unexpected data: %s. Expected: %s", inputData, "TEST")
+	}
+	if sendErr != apiErr {
+		t.Errorf("Send did not report API error: %s. Expected: %s", sendErr, apiErr)
+	}
+	if len(out) == 0 {
+		t.Error("Unexpected empty stdout")
+	}
+	if len(err) != 0 {
+		t.Errorf("Unexpected stderr: %s", err)
+	}
+}
+
+func TestSendWithOptions(t *testing.T) {
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	to := []string{"bob@example.org"}
+	data := []byte{'T', 'E', 'S', 'T'}
+	setName := "test"
+	identityArn := "arn:aws:ses:eu-west-1:123456789012:identity/example.org"
+	contactList := "list"
+	topic := ""
+	client, err := New(
+		&setName,
+		&identityArn,
+		map[string]string{"b": "2", "a": "1"},
+		&contactList,
+		&topic,
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	client.sesv2API = &mockSESV2API{}
+	defer func() {
+		testData.input = nil
+	}()
+	originalOut := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	err = client.Send(&origin, from, to, data)
+	os.Stdout = originalOut
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	input := testData.input
+	if *input.ConfigurationSetName != setName {
+		t.Errorf(
+			"Unexpected configuration set: %s. Expected: %s",
+			*input.ConfigurationSetName,
+			setName,
+		)
+	}
+	if *input.FromEmailAddressIdentityArn != identityArn {
+		t.Errorf(
+			"Unexpected identity ARN: %s. Expected: %s",
+			*input.FromEmailAddressIdentityArn,
+			identityArn,
+		)
+	}
+	if len(input.EmailTags) != 2 ||
+		*input.EmailTags[0].Name != "a" || *input.EmailTags[0].Value != "1" ||
+		*input.EmailTags[1].Name != "b" || *input.EmailTags[1].Value != "2" {
+		t.Errorf("Unexpected email tags: %v", input.EmailTags)
+	}
+	if *input.ListManagementOptions.ContactListName != contactList {
+		t.Errorf(
+			"Unexpected contact list: %s. Expected: %s",
+			*input.ListManagementOptions.ContactListName,
+			contactList,
+		)
+	}
+	if input.ListManagementOptions.TopicName != nil {
+		t.Errorf(
+			"Unexpected topic: %s",
+			*input.ListManagementOptions.TopicName,
+		)
+	}
+}
+
+func TestSendWithEmptyOptions(t *testing.T) {
+	origin := net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	from := "alice@example.org"
+	to := []string{"bob@example.org"}
+	data := []byte{'T', 'E', 'S', 'T'}
+	setName := ""
+	input, _, _, _ := sendHelper(&origin, from, to, data, &setName, nil, nil, nil)
+	if input.ConfigurationSetName != nil {
+		t.Errorf(
+			"Unexpected configuration set: %s",
+			*input.ConfigurationSetName,
+		)
+	}
+	if input.FromEmailAddressIdentityArn != nil {
+		t.Errorf(
+			"Unexpected identity ARN: %s",
+			*input.FromEmailAddressIdentityArn,
+		)
+	}
+	if input.EmailTags != nil {
+		t.Errorf("Unexpected email tags: %v", input.EmailTags)
+	}
+	if input.ListManagementOptions != nil {
+		t.Errorf(
+			"Unexpected list management options: %v",
+			input.ListManagementOptions,
+		)
+	}
+}
+
+func TestNew(t *testing.T) {
+	setName := ""
+	identityArn := ""
+	contactList := ""
+	topic := ""
+	allowFromRegExp, _ := regexp.Compile(`^admin@example\.org$`)
+	denyToRegExp, _ := regexp.Compile(`^bob@example\.org$`)
+	client, err := New(
+		&setName,
+		&identityArn,
+		nil,
+		&contactList,
+		&topic,
+		allowFromRegExp,
+		denyToRegExp,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, ok := interface{}(client).(relay.Client)
+	if !ok {
+		t.Error("Unexpected: client is not a relay.Client")
+	}
+	if client.setName != &setName {
+		t.Errorf("Unexpected setName: %s", *client.setName)
+	}
+	if client.identityArn != &identityArn {
+		t.Errorf("Unexpected identityArn: %s", *client.identityArn)
+	}
+	if client.emailTags != nil {
+		t.Errorf("Unexpected emailTags: %v", client.emailTags)
+	}
+	if client.listManagementOptions != nil {
+		t.Errorf(
+			"Unexpected listManagementOptions: %v",
+			client.listManagementOptions,
+		)
+	}
+	if client.allowFromRegExp != allowFromRegExp {
+		t.Errorf("Unexpected allowFromRegExp: %s", client.allowFromRegExp)
+	}
+	if client.denyToRegExp != denyToRegExp {
+		t.Errorf("Unexpected denyToRegExp: %s", client.denyToRegExp)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c := Client{sesv2API: &mockSESV2API{}}
+	if err := c.Check(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	testData.err = errors.New("ERROR")
+	defer func() { testData.err = nil }()
+	if err := c.Check(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestMaxSendRate(t *testing.T) {
+	c := Client{sesv2API: &mockSESV2API{}}
+	rate, err := c.MaxSendRate()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if rate != 14 {
+		t.Errorf("Unexpected max send rate: %f. Expected: %d", rate, 14)
+	}
+	testData.err = errors.New("ERROR")
+	defer func() { testData.err = nil }()
+	if _, err := c.MaxSendRate(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
@@ -0,0 +1,270 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
+)
+
+const (
+	deadDirName  = "dead"
+	fileSuffix   = ".json"
+	tmpPrefix    = ".tmp-"
+	pollInterval = time.Second
+	minBackoff   = 10 * time.Second
+	maxBackoff   = time.Hour
+)
+
+type message struct {
+	Time       time.Time
+	Next       time.Time
+	Attempts   int
+	IP         string
+	User       string
+	TLSVersion string
+	TLSCipher  string
+	From       string
+	To         []string
+	Data       []byte
+}
+
+// Client implements the Relay interface.
+type Client struct {
+	client  relay.Client
+	dir     string
+	deadDir string
+	maxAge  time.Duration
+	now     func() time.Time
+}
+
+// Send stores the email data in the spool directory for asynchronous delivery
+func (c Client) Send(
+	origin net.Addr,
+	from string,
+	to []string,
+	data []byte,
+) error {
+	now := c.now()
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	tlsVersion, tlsCipher := session.TLS(origin)
+	return c.write(fileName(now, hex.EncodeToString(id)), &message{
+		Time:       now,
+		Next:       now,
+		IP:         session.IP(origin).String(),
+		User:       session.User(origin),
+		TLSVersion: tlsVersion,
+		TLSCipher:  tlsCipher,
+		From:       from,
+		To:         to,
+		Data:       data,
+	})
+}
+
+// Deliver sends all spooled messages which are due for a delivery attempt.
+// Messages that fail with a temporary error are rescheduled with exponential
+// backoff. On partial failure, only the failed recipients are rescheduled.
+// Messages failing with a permanent error, exceeding the maximum age or with a
+// denied sender are moved to the dead-letter directory.
+// The due time is read from the file name, so messages which are not due are
+// not read.
+// Returns the first spool file error, after processing all messages.
+func (c Client) Deliver() (err error) {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !file.Mode().IsRegular() || strings.HasPrefix(name, tmpPrefix) ||
+			!strings.HasSuffix(name, fileSuffix) || !due(name, c.now()) {
+			continue
+		}
+		if fileErr := c.deliver(name); fileErr != nil && err == nil {
+			err = fileErr
+		}
+	}
+	return
+}
+
+// Run calls Deliver in a fixed interval until the stop channel is closed.
+func (c Client) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.Deliver(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check verifies the API access of the underlying relay client, if supported.
+func (c Client) Check() error {
+	if checker, ok := c.client.(relay.Checker); ok {
+		return checker.Check()
+	}
+	return nil
+}
+
+func (c Client) deliver(name string) error {
+	path := filepath.Join(c.dir, name)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	m := &message{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return c.bury(name)
+	}
+	now := c.now()
+	if now.Before(m.Next) {
+		return nil
+	}
+	origin := &session.Addr{
+		TCPAddr:    net.TCPAddr{IP: net.ParseIP(m.IP)},
+		User:       m.User,
+		TLSVersion: m.TLSVersion,
+		TLSCipher:  m.TLSCipher,
+	}
+	err = c.client.Send(origin, m.From, m.To, m.Data)
+	var partialErr *relay.PartialError
+	if errors.As(err, &partialErr) {
+		// Only retry the recipients which have not received the message yet:
+		m.To = partialErr.Recipients
+	}
+	switch {
+	case err == nil, err == relay.ErrDeniedRecipients:
+		// Denied recipients have been logged and allowed ones have received the
+		// message, so a retry would only cause duplicate deliveries.
+		return os.Remove(path)
+	case err == relay.ErrDeniedSender:
+		return c.bury(name)
+	case !relay.Temporary(err):
+		if partialErr != nil {
+			// Keep only the failed recipients in the dead-letter file:
+			if err := c.write(name, m); err != nil {
+				return err
+			}
+		}
+		return c.bury(name)
+	case now.Sub(m.Time) >= c.maxAge:
+		relay.Log(origin, &m.From, relay.Pointers(m.To), relay.ErrExpired)
+		return c.bury(name)
+	}
+	m.Attempts++
+	m.Next = now.Add(backoff(m.Attempts))
+	if err := c.write(name, m); err != nil {
+		return err
+	}
+	// Update the due time in the file name after the content, so the message
+	// is delivered early instead of twice if the rename fails:
+	return os.Rename(path, filepath.Join(c.dir, fileName(m.Next, messageID(name))))
+}
+
+// fileName returns the spool file name for the message with the given id,
+// prefixed with its due time.
+func fileName(next time.Time, id string) string {
+	return fmt.Sprintf("%d-%s%s", next.UnixNano(), id, fileSuffix)
+}
+
+// messageID returns the message id of the given spool file name.
+func messageID(name string) string {
+	name = strings.TrimSuffix(name, fileSuffix)
+	if i := strings.Index(name, "-"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// due reports whether the message of the given spool file name is due for a
+// delivery attempt at the given time.
+// File names without due time are always due.
+func due(name string, now time.Time) bool {
+	i := strings.Index(name, "-")
+	if i < 0 {
+		return true
+	}
+	next, err := strconv.ParseInt(name[:i], 10, 64)
+	return err != nil || !now.Before(time.Unix(0, next))
+}
+
+// write stores the message atomically via temporary file and rename.
+func (c Client) write(name string, m *message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(c.dir, tmpPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(b)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// bury moves the message to the dead-letter directory.
+func (c Client) bury(name string) error {
+	return os.Rename(filepath.Join(c.dir, name), filepath.Join(c.deadDir, name))
+}
+
+func backoff(attempts int) time.Duration {
+	d := minBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// New creates a new client which spools messages in the given directory and
+// delivers them via the given relay client.
+// Messages which could not be delivered within maxAge are moved to the "dead"
+// subdirectory.
+func New(
+	client relay.Client,
+	dir string,
+	maxAge time.Duration,
+) (Client, error) {
+	deadDir := filepath.Join(dir, deadDirName)
+	err := os.MkdirAll(deadDir, 0700)
+	return Client{
+		client:  client,
+		dir:     dir,
+		deadDir: deadDir,
+		maxAge:  maxAge,
+		now:     time.Now,
+	}, err
+}
@@ -0,0 +1,392 @@
+package relay
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
+)
+
+var errThrottling = awserr.New("Throttling", "Maximum sending rate exceeded.", nil)
+
+type mockClient struct {
+	calls  int
+	origin net.Addr
+	from   string
+	to     []string
+	data   []byte
+	err    error
+}
+
+func (m *mockClient) Send(
+	origin net.Addr,
+	from string,
+	to []string,
+	data []byte,
+) error {
+	m.calls++
+	m.origin = origin
+	m.from = from
+	m.to = to
+	m.data = data
+	return m.err
+}
+
+func (m *mockClient) Check() error {
+	return m.err
+}
+
+func clientHelper(t *testing.T, mock *mockClient, now time.Time) Client {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected temp dir creation error: %s", err)
+	}
+	c, err := New(mock, dir, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c.now = func() time.Time { return now }
+	return c
+}
+
+func sendHelper(t *testing.T, c Client) {
+	origin := session.Addr{
+		TCPAddr:    net.TCPAddr{IP: []byte{127, 0, 0, 1}},
+		User:       "alice",
+		TLSVersion: "TLS 1.3",
+		TLSCipher:  "TLS_AES_128_GCM_SHA256",
+	}
+	from := "alice@example.org"
+	to := []string{"bob@example.org"}
+	data := []byte{'T', 'E', 'S', 'T'}
+	err := c.Send(&origin, from, to, data)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func deliverHelper(c Client) (out []byte, err error) {
+	outReader, outWriter, _ := os.Pipe()
+	originalOut := os.Stdout
+	defer func() {
+		os.Stdout = originalOut
+	}()
+	os.Stdout = outWriter
+	func() {
+		err = c.Deliver()
+		outWriter.Close()
+	}()
+	out, _ = ioutil.ReadAll(outReader)
+	return
+}
+
+func listFiles(dir string) []string {
+	names := []string{}
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			names = append(names, file.Name())
+		}
+	}
+	return names
+}
+
+func TestSend(t *testing.T) {
+	mock := &mockClient{}
+	c := clientHelper(t, mock, time.Now())
+	defer os.RemoveAll(c.dir)
+	sendHelper(t, c)
+	if mock.calls != 0 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 0)
+	}
+	files := listFiles(c.dir)
+	if len(files) != 1 {
+		t.Errorf("Unexpected number of spool files: %d. Expected: %d", len(files), 1)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	mock := &mockClient{}
+	c := clientHelper(t, mock, time.Now())
+	defer os.RemoveAll(c.dir)
+	sendHelper(t, c)
+	_, err := deliverHelper(c)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if mock.calls != 1 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 1)
+	}
+	ip := session.IP(mock.origin).String()
+	if ip != "127.0.0.1" {
+		t.Errorf("Unexpected origin IP: %s. Expected: %s", ip, "127.0.0.1")
+	}
+	if user := session.User(mock.origin); user != "alice" {
+		t.Errorf("Unexpected origin user: %s. Expected: %s", user, "alice")
+	}
+	version, cipher := session.TLS(mock.origin)
+	if version != "TLS 1.3" || cipher != "TLS_AES_128_GCM_SHA256" {
+		t.Errorf("Unexpected origin TLS: %s, %s", version, cipher)
+	}
+	if mock.from != "alice@example.org" {
+		t.Errorf("Unexpected from: %s. Expected: %s", mock.from, "alice@example.org")
+	}
+	if len(mock.to) != 1 || mock.to[0] != "bob@example.org" {
+		t.Errorf("Unexpected to: %s. Expected: %s", mock.to, "[bob@example.org]")
+	}
+	if string(mock.data) != "TEST" {
+		t.Errorf("Unexpected data: %s. Expected: %s", mock.data, "TEST")
+	}
+	if files := listFiles(c.dir); len(files) != 0 {
+		t.Errorf("Unexpected spool files: %s", files)
+	}
+}
+
+func TestDeliverWithApiError(t *testing.T) {
+	now := time.Now()
+	mock := &mockClient{err: errThrottling}
+	c := clientHelper(t, mock, now)
+	defer os.RemoveAll(c.dir)
+	sendHelper(t, c)
+	deliverHelper(c)
+	deliverHelper(c)
+	if mock.calls != 1 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 1)
+	}
+	if files := listFiles(c.dir); len(files) != 1 {
+		t.Errorf("Unexpected number of spool files: %d. Expected: %d", len(files), 1)
+	}
+	c.now = func() time.Time { return now.Add(minBackoff) }
+	deliverHelper(c)
+	if mock.calls != 2 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 2)
+	}
+	c.now = func() time.Time { return now.Add(2 * minBackoff) }
+	deliverHelper(c)
+	if mock.calls != 2 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 2)
+	}
+	mock.err = nil
+	c.now = func() time.Time { return now.Add(3 * minBackoff) }
+	deliverHelper(c)
+	if mock.calls != 3 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 3)
+	}
+	if files := listFiles(c.dir); len(files) != 0 {
+		t.Errorf("Unexpected spool files: %s", files)
+	}
+}
+
+func TestDeliverWithPermanentError(t *testing.T) {
+	mock := &mockClient{err: &relay.PartialError{
+		Recipients: []string{"carol@example.org"},
+		Err:        awserr.New("MessageRejected", "Email address is not verified.", nil),
+	}}
+	c := clientHelper(t, mock, time.Now())
+	defer os.RemoveAll(c.dir)
+	sendHelper(t, c)
+	deliverHelper(c)
+	if mock.calls != 1 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 1)
+	}
+	if files := listFiles(c.dir); len(files) != 0 {
+		t.Errorf("Unexpected spool files: %s", files)
+	}
+	files := listFiles(c.deadDir)
+	if len(files) != 1 {
+		t.Fatalf("Unexpected number of dead files: %d. Expected: %d", len(files), 1)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(c.deadDir, files[0]))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(string(b), "bob@example.org") {
+		t.Errorf("Unexpected delivered recipient in dead file: %s", b)
+	}
+}
+
+func TestDeliverSkipsMessagesNotDue(t *testing.T) {
+	now := time.Now()
+	mock := &mockClient{err: errThrottling}
+	c := clientHelper(t, mock, now)
+	defer os.RemoveAll(c.dir)
+	sendHelper(t, c)
+	deliverHelper(c)
+	files := listFiles(c.dir)
+	if len(files) != 1 {
+		t.Fatalf("Unexpected number of spool files: %d. Expected: %d", len(files), 1)
+	}
+	next := strconv.FormatInt(now.Add(minBackoff).UnixNano(), 10)
+	if !strings.HasPrefix(files[0], next+"-") {
+		t.Errorf("Unexpected spool file name: %s", files[0])
+	}
+	// A message which is not due is skipped without reading the file:
+	path := filepath.Join(c.dir, files[0])
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	deliverHelper(c)
+	if files := listFiles(c.deadDir); len(files) != 0 {
+		t.Errorf("Unexpected dead files: %s", files)
+	}
+	c.now = func() time.Time { return now.Add(minBackoff) }
+	deliverHelper(c)
+	if files := listFiles(c.deadDir); len(files) != 1 {
+		t.Errorf("Unexpected number of dead files: %d. Expected: %d", len(files), 1)
+	}
+}
+
+func TestDeliverWithExpiredMessage(t *testing.T) {
+	now := time.Now()
+	mock := &mockClient{err: errThrottling}
+	c := clientHelper(t, mock, now)
+	defer os.RemoveAll(c.dir)
+	sendHelper(t, c)
+	c.now = func() time.Time { return now.Add(c.maxAge) }
+	out, _ := deliverHelper(c)
+	if mock.calls != 1 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 1)
+	}
+	if len(out) == 0 {
+		t.Error("Unexpected empty stdout")
+	}
+	if files := listFiles(c.dir); len(files) != 0 {
+		t.Errorf("Unexpected spool files: %s", files)
+	}
+	if files := listFiles(c.deadDir); len(files) != 1 {
+		t.Errorf("Unexpected number of dead files: %d. Expected: %d", len(files), 1)
+	}
+}
+
+func TestDeliverWithDeniedSender(t *testing.T) {
+	mock := &mockClient{err: relay.ErrDeniedSender}
+	c := clientHelper(t, mock, time.Now())
+	defer os.RemoveAll(c.dir)
+	sendHelper(t, c)
+	deliverHelper(c)
+	if files := listFiles(c.dir); len(files) != 0 {
+		t.Errorf("Unexpected spool files: %s", files)
+	}
+	if files := listFiles(c.deadDir); len(files) != 1 {
+		t.Errorf("Unexpected number of dead files: %d. Expected: %d", len(files), 1)
+	}
+}
+
+func TestDeliverWithDeniedRecipients(t *testing.T) {
+	mock := &mockClient{err: relay.ErrDeniedRecipients}
+	c := clientHelper(t, mock, time.Now())
+	defer os.RemoveAll(c.dir)
+	sendHelper(t, c)
+	deliverHelper(c)
+	if files := listFiles(c.dir); len(files) != 0 {
+		t.Errorf("Unexpected spool files: %s", files)
+	}
+	if files := listFiles(c.deadDir); len(files) != 0 {
+		t.Errorf("Unexpected dead files: %s", files)
+	}
+}
+
+func TestDeliverWithPartialError(t *testing.T) {
+	now := time.Now()
+	mock := &mockClient{err: &relay.PartialError{
+		Recipients: []string{"carol@example.org"},
+		Err:        errThrottling,
+	}}
+	c := clientHelper(t, mock, now)
+	defer os.RemoveAll(c.dir)
+	sendHelper(t, c)
+	deliverHelper(c)
+	if files := listFiles(c.dir); len(files) != 1 {
+		t.Errorf("Unexpected number of spool files: %d. Expected: %d", len(files), 1)
+	}
+	mock.err = nil
+	c.now = func() time.Time { return now.Add(minBackoff) }
+	deliverHelper(c)
+	if mock.calls != 2 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 2)
+	}
+	if len(mock.to) != 1 || mock.to[0] != "carol@example.org" {
+		t.Errorf("Unexpected to: %s. Expected: %s", mock.to, "[carol@example.org]")
+	}
+	if files := listFiles(c.dir); len(files) != 0 {
+		t.Errorf("Unexpected spool files: %s", files)
+	}
+}
+
+func TestDeliverWithInvalidFile(t *testing.T) {
+	mock := &mockClient{}
+	c := clientHelper(t, mock, time.Now())
+	defer os.RemoveAll(c.dir)
+	err := ioutil.WriteFile(filepath.Join(c.dir, "invalid.json"), []byte("{"), 0600)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	deliverHelper(c)
+	if mock.calls != 0 {
+		t.Errorf("Unexpected number of relay calls: %d. Expected: %d", mock.calls, 0)
+	}
+	if files := listFiles(c.deadDir); len(files) != 1 {
+		t.Errorf("Unexpected number of dead files: %d. Expected: %d", len(files), 1)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if d := backoff(1); d != minBackoff {
+		t.Errorf("Unexpected backoff: %s. Expected: %s", d, minBackoff)
+	}
+	if d := backoff(3); d != 4*minBackoff {
+		t.Errorf("Unexpected backoff: %s. Expected: %s", d, 4*minBackoff)
+	}
+	if d := backoff(100); d != maxBackoff {
+		t.Errorf("Unexpected backoff: %s. Expected: %s", d, maxBackoff)
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Unexpected temp dir creation error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	mock := &mockClient{}
+	client, err := New(mock, dir, time.Hour)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	_, ok := interface{}(client).(relay.Client)
+	if !ok {
+		t.Error("Unexpected: client is not a relay.Client")
+	}
+	if client.client != mock {
+		t.Errorf("Unexpected client: %v", client.client)
+	}
+	if client.maxAge != time.Hour {
+		t.Errorf("Unexpected maxAge: %s", client.maxAge)
+	}
+	info, err := os.Stat(client.deadDir)
+	if err != nil || !info.IsDir() {
+		t.Errorf("Unexpected dead-letter directory error: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	mock := &mockClient{}
+	c := clientHelper(t, mock, time.Now())
+	defer os.RemoveAll(c.dir)
+	if err := c.Check(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	mock.err = errors.New("API failure")
+	if err := c.Check(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Package session provides a network listener, which annotates client
+connections with the state of their SMTP session.
+*/
+package session
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+)
+
+// Addr is the remote address of a client connection, which also carries the
+// state of the associated SMTP session.
+type Addr struct {
+	net.TCPAddr
+	// User is the name of the authenticated user.
+	User string
+	// Recipients is the number of accepted recipients of the current email.
+	Recipients int
+	// TLSVersion is the negotiated TLS version, empty without TLS.
+	TLSVersion string
+	// TLSCipher is the negotiated TLS cipher suite, empty without TLS.
+	TLSCipher string
+}
+
+type conn struct {
+	net.Conn
+	addr *Addr
+}
+
+// RemoteAddr returns the session address of the connection.
+func (c *conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+type listener struct {
+	net.Listener
+}
+
+// Accept waits for and returns the next connection, annotated with a new
+// session address.
+func (l listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr := &Addr{}
+	if tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		addr.TCPAddr = *tcpAddr
+	}
+	return &conn{Conn: c, addr: addr}, nil
+}
+
+// NewListener wraps the given listener to annotate accepted connections with
+// session state, available via type assertion of their RemoteAddr to *Addr.
+func NewListener(l net.Listener) net.Listener {
+	return listener{l}
+}
+
+// IP returns the IP of the given TCP or session address.
+func IP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *Addr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// User returns the authenticated user of the given session address or an
+// empty string for other address types.
+func User(addr net.Addr) string {
+	if a, ok := addr.(*Addr); ok {
+		return a.User
+	}
+	return ""
+}
+
+// versionName returns the name of the given TLS version.
+func versionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return "0x" + strconv.FormatUint(uint64(version), 16)
+}
+
+// HandlerTLS records the negotiated TLS version and cipher suite of the given
+// connection state on the given session address.
+func HandlerTLS(addr net.Addr, state tls.ConnectionState) {
+	if a, ok := addr.(*Addr); ok {
+		a.TLSVersion = versionName(state.Version)
+		a.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	}
+}
+
+// TLS returns the negotiated TLS version and cipher suite of the given session
+// address or empty strings without TLS or for other address types.
+func TLS(addr net.Addr) (version, cipher string) {
+	if a, ok := addr.(*Addr); ok {
+		return a.TLSVersion, a.TLSCipher
+	}
+	return "", ""
+}
@@ -0,0 +1,89 @@
+package session
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err)
+	}
+	ln = NewListener(ln)
+	defer ln.Close()
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected accept error: %s", err)
+	}
+	defer c.Close()
+	addr, ok := c.RemoteAddr().(*Addr)
+	if !ok {
+		t.Fatalf("Unexpected remote address type: %T", c.RemoteAddr())
+	}
+	if addr.IP.String() != "127.0.0.1" {
+		t.Errorf("Unexpected IP: %s. Expected: %s", addr.IP, "127.0.0.1")
+	}
+	if addr.Port == 0 {
+		t.Error("Unexpected empty port")
+	}
+	if addr.Network() != "tcp" {
+		t.Errorf("Unexpected network: %s. Expected: %s", addr.Network(), "tcp")
+	}
+	if addr.User != "" {
+		t.Errorf("Unexpected user: %s", addr.User)
+	}
+}
+
+func TestIP(t *testing.T) {
+	tcpAddr := &net.TCPAddr{IP: []byte{127, 0, 0, 1}}
+	if ip := IP(tcpAddr); ip.String() != "127.0.0.1" {
+		t.Errorf("Unexpected TCP address IP: %s. Expected: %s", ip, "127.0.0.1")
+	}
+	addr := &Addr{TCPAddr: *tcpAddr}
+	if ip := IP(addr); ip.String() != "127.0.0.1" {
+		t.Errorf("Unexpected session address IP: %s. Expected: %s", ip, "127.0.0.1")
+	}
+	if ip := IP(&net.UnixAddr{}); ip != nil {
+		t.Errorf("Unexpected Unix address IP: %s", ip)
+	}
+}
+
+func TestUser(t *testing.T) {
+	addr := &Addr{User: "alice"}
+	if user := User(addr); user != "alice" {
+		t.Errorf("Unexpected user: %s. Expected: %s", user, "alice")
+	}
+	if user := User(&net.TCPAddr{}); user != "" {
+		t.Errorf("Unexpected TCP address user: %s", user)
+	}
+}
+
+func TestHandlerTLS(t *testing.T) {
+	addr := &Addr{}
+	HandlerTLS(addr, tls.ConnectionState{
+		Version:     tls.VersionTLS12,
+		CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	})
+	version, cipher := TLS(addr)
+	if version != "TLS 1.2" {
+		t.Errorf("Unexpected TLS version: %s. Expected: %s", version, "TLS 1.2")
+	}
+	if cipher != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" {
+		t.Errorf("Unexpected TLS cipher: %s", cipher)
+	}
+	HandlerTLS(addr, tls.ConnectionState{Version: 0x0200})
+	if addr.TLSVersion != "0x200" {
+		t.Errorf("Unexpected unknown TLS version: %s", addr.TLSVersion)
+	}
+	if version, cipher := TLS(&net.TCPAddr{}); version != "" || cipher != "" {
+		t.Errorf("Unexpected TCP address TLS: %s %s", version, cipher)
+	}
+}
@@ -1,72 +1,782 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
 	"github.com/blueimp/aws-smtp-relay/internal/auth"
+	"github.com/blueimp/aws-smtp-relay/internal/certificate"
+	"github.com/blueimp/aws-smtp-relay/internal/config"
+	"github.com/blueimp/aws-smtp-relay/internal/handoff"
+	"github.com/blueimp/aws-smtp-relay/internal/metrics"
+	"github.com/blueimp/aws-smtp-relay/internal/network"
+	"github.com/blueimp/aws-smtp-relay/internal/policy"
 	"github.com/blueimp/aws-smtp-relay/internal/relay"
 	pinpointrelay "github.com/blueimp/aws-smtp-relay/internal/relay/pinpoint"
+	ratelimitrelay "github.com/blueimp/aws-smtp-relay/internal/relay/ratelimit"
+	routerrelay "github.com/blueimp/aws-smtp-relay/internal/relay/router"
 	sesrelay "github.com/blueimp/aws-smtp-relay/internal/relay/ses"
-	"github.com/mhale/smtpd"
+	sesv2relay "github.com/blueimp/aws-smtp-relay/internal/relay/sesv2"
+	spoolrelay "github.com/blueimp/aws-smtp-relay/internal/relay/spool"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
+	"github.com/blueimp/aws-smtp-relay/internal/smtpd"
 )
 
 var (
-	addr      = flag.String("a", ":1025", "TCP listen address")
-	name      = flag.String("n", "AWS SMTP Relay", "SMTP service name")
-	host      = flag.String("h", "", "Server hostname")
-	certFile  = flag.String("c", "", "TLS cert file")
-	keyFile   = flag.String("k", "", "TLS key file")
-	startTLS  = flag.Bool("s", false, "Require TLS via STARTTLS extension")
-	onlyTLS   = flag.Bool("t", false, "Listen for incoming TLS connections only")
-	relayAPI  = flag.String("r", "ses", "Relay API to use (ses|pinpoint)")
-	setName   = flag.String("e", "", "Amazon SES Configuration Set Name")
-	ips       = flag.String("i", "", "Allowed client IPs (comma-separated)")
-	user      = flag.String("u", "", "Authentication username")
-	allowFrom = flag.String("l", "", "Allowed sender emails regular expression")
-	denyTo    = flag.String("d", "", "Denied recipient emails regular expression")
+	addr       = flag.String("a", ":1025", "TCP listen address")
+	name       = flag.String("n", "AWS SMTP Relay", "SMTP service name")
+	host       = flag.String("h", "", "Server hostname")
+	certFile   = flag.String("c", "", "TLS cert file")
+	keyFile    = flag.String("k", "", "TLS key file or PKCS#12 bundle")
+	clientCA   = flag.String("A", "", "TLS client CA file for client certificate authentication")
+	clientReq  = flag.Bool("V", false, "Require TLS client certificates")
+	clientMap  = flag.String("M", "", "TLS client certificate identities to users (comma-separated identity=user)")
+	tlsMin     = flag.String("tlsMinVersion", "", "Minimum TLS version (1.0|1.1|1.2|1.3)")
+	tlsMax     = flag.String("tlsMaxVersion", "", "Maximum TLS version (1.0|1.1|1.2|1.3)")
+	tlsCiphers = flag.String("tlsCiphers", "", "TLS 1.0-1.2 cipher suites (comma-separated)")
+	tlsCurves  = flag.String("tlsCurves", "", "TLS curve preferences (comma-separated X25519|P256|P384|P521)")
+	startTLS   = flag.Bool("s", false, "Require TLS via STARTTLS extension")
+	onlyTLS    = flag.Bool("t", false, "Listen for incoming TLS connections only")
+	relayAPI   = flag.String("r", "ses", "Relay API to use (ses|sesv2|pinpoint)")
+	setName    = flag.String("e", "", "Amazon SES Configuration Set Name")
+	fromArn    = flag.String("f", "", "Amazon SES v2 From Email Address Identity ARN")
+	emailTags  = flag.String("g", "", "Amazon SES v2 and Pinpoint Email Tags (comma-separated name=value)")
+	listOpts   = flag.String("o", "", "Amazon SES v2 List Management Options (list[:topic])")
+	feedbackTo = flag.String("feedbackTo", "", "Amazon Pinpoint Feedback Forwarding Email Address")
+	replyTo    = flag.String("replyTo", "", "Amazon Pinpoint Reply-To Addresses (comma-separated)")
+	regions    = flag.String("regions", "", "Amazon SES regions in failover order (comma-separated)")
+	endpoint   = flag.String("awsEndpoint", "", "AWS API endpoint URL")
+	awsRegion  = flag.String("awsRegion", "", "AWS region (overrides AWS_REGION)")
+	maxRetries = flag.Int("awsMaxRetries", -1, "Maximum number of AWS API request retries (negative for the SDK default)")
+	ips        = flag.String("i", "", "Allowed client IPs or CIDR ranges (comma-separated)")
+	denyIPs    = flag.String("b", "", "Denied client IPs or CIDR ranges (comma-separated)")
+	trustedIPs = flag.String("T", "", "Trusted client IPs or CIDR ranges without authentication (comma-separated)")
+	checkIPs   = flag.Bool("C", false, "Check client IPs on connection")
+	user       = flag.String("u", "", "Authentication username")
+	usersFile  = flag.String("U", "", "Authentication users file (htpasswd format)")
+	allowFrom  = flag.String("l", "", "Allowed sender emails regular expression")
+	denyTo     = flag.String("d", "", "Denied recipient emails regular expression")
+	rateLimit  = flag.String("rateLimit", "", "Send rate limit in recipients per second (number|quota)")
+	rateWait   = flag.Duration("rateWait", 0, "Maximum wait for the send rate limit before deferring")
+	spoolDir   = flag.String("q", "", "Spool directory for queued delivery")
+	spoolAge   = flag.Duration("Q", 24*time.Hour, "Maximum age of spooled emails")
+	policyFile = flag.String("p", "", "Sender and recipient policies file (JSON)")
+	adminAddr  = flag.String("m", "", "HTTP listen address for metrics and health checks")
+	checkAPI   = flag.Bool("R", false, "Check relay API access for readiness")
+	drainTime  = flag.Duration("w", 30*time.Second, "Graceful shutdown timeout")
+	configFile = flag.String("config", "", "Configuration file (YAML)")
 )
 
-var ipMap map[string]bool
+// configKeys maps configuration file keys to flag names.
+var configKeys = map[string]string{
+	"listen":                      "a",
+	"name":                        "n",
+	"host":                        "h",
+	"tlsCert":                     "c",
+	"tlsKey":                      "k",
+	"tlsClientCA":                 "A",
+	"tlsClientRequired":           "V",
+	"tlsClientUsers":              "M",
+	"tlsMinVersion":               "tlsMinVersion",
+	"tlsMaxVersion":               "tlsMaxVersion",
+	"tlsCiphers":                  "tlsCiphers",
+	"tlsCurves":                   "tlsCurves",
+	"startTLS":                    "s",
+	"onlyTLS":                     "t",
+	"relayAPI":                    "r",
+	"configurationSet":            "e",
+	"fromEmailAddressIdentityArn": "f",
+	"emailTags":                   "g",
+	"listManagementOptions":       "o",
+	"feedbackForwardingAddress":   "feedbackTo",
+	"replyToAddresses":            "replyTo",
+	"regions":                     "regions",
+	"awsEndpoint":                 "awsEndpoint",
+	"awsRegion":                   "awsRegion",
+	"awsMaxRetries":               "awsMaxRetries",
+	"allowIPs":                    "i",
+	"denyIPs":                     "b",
+	"trustedIPs":                  "T",
+	"checkIPs":                    "C",
+	"user":                        "u",
+	"usersFile":                   "U",
+	"allowFrom":                   "l",
+	"denyTo":                      "d",
+	"rateLimit":                   "rateLimit",
+	"rateWait":                    "rateWait",
+	"spoolDir":                    "q",
+	"spoolAge":                    "Q",
+	"policiesFile":                "p",
+	"adminListen":                 "m",
+	"checkAPI":                    "R",
+	"shutdownTimeout":             "w",
+}
+
+// configEnv maps configuration file keys to environment variables.
+var configEnv = map[string]string{
+	"bcryptHash": "BCRYPT_HASH",
+	"password":   "PASSWORD",
+	"tlsKeyPass": "TLS_KEY_PASS",
+}
+
+var allowNets network.List
+var denyNets network.List
+var trustedNets network.List
 var bcryptHash []byte
 var password []byte
+var users map[string][]byte
+var clientCAs *x509.CertPool
+var certUsers map[string]string
+var policies *policy.Policies
+var globalPolicy *policy.Policy
+var listeners []listenerSettings
 var relayClient relay.Client
+var awsCredentials *credentials.Credentials
+var overrides map[string]bool
+var serving int32
+
+// settingsMu guards the settings against concurrent reads during a reload.
+var settingsMu sync.RWMutex
+
+// settings holds the configuration state replaced on reload.
+type settings struct {
+	allowNets      network.List
+	denyNets       network.List
+	trustedNets    network.List
+	bcryptHash     []byte
+	password       []byte
+	users          map[string][]byte
+	clientCAs      *x509.CertPool
+	certUsers      map[string]string
+	policies       *policy.Policies
+	globalPolicy   *policy.Policy
+	listeners      []listenerSettings
+	relayClient    relay.Client
+	awsCredentials *credentials.Credentials
+	// flags and env hold the values a configuration file may change, with nil
+	// for unset environment variables.
+	flags map[string]string
+	env   map[string]*string
+}
+
+func currentSettings() settings {
+	s := settings{
+		allowNets:      allowNets,
+		denyNets:       denyNets,
+		trustedNets:    trustedNets,
+		bcryptHash:     bcryptHash,
+		password:       password,
+		users:          users,
+		clientCAs:      clientCAs,
+		certUsers:      certUsers,
+		policies:       policies,
+		globalPolicy:   globalPolicy,
+		listeners:      listeners,
+		relayClient:    relayClient,
+		awsCredentials: awsCredentials,
+		flags:          make(map[string]string),
+		env:            make(map[string]*string),
+	}
+	flag.VisitAll(func(fl *flag.Flag) {
+		s.flags[fl.Name] = fl.Value.String()
+	})
+	for _, name := range configEnv {
+		if value, exists := os.LookupEnv(name); exists {
+			s.env[name] = &value
+		} else {
+			s.env[name] = nil
+		}
+	}
+	return s
+}
 
-func server() (srv *smtpd.Server, err error) {
+func (s settings) restore() {
+	allowNets = s.allowNets
+	denyNets = s.denyNets
+	trustedNets = s.trustedNets
+	bcryptHash = s.bcryptHash
+	password = s.password
+	users = s.users
+	clientCAs = s.clientCAs
+	certUsers = s.certUsers
+	policies = s.policies
+	globalPolicy = s.globalPolicy
+	listeners = s.listeners
+	relayClient = s.relayClient
+	awsCredentials = s.awsCredentials
+	for name, value := range s.flags {
+		flag.Set(name, value)
+	}
+	for name, value := range s.env {
+		if value == nil {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, *value)
+		}
+	}
+}
+
+// listenerSettings holds the settings of an SMTP listener.
+type listenerSettings struct {
+	addr     string
+	startTLS bool
+	onlyTLS  bool
+	// requireAuth overrides the authentication requirement if not nil.
+	requireAuth *bool
+	policies    *policy.Policies
+}
+
+// sender returns a handler relaying emails via the given client, recording
+// their recipients and size metrics.
+func sender(client relay.Client) smtpd.Handler {
+	return func(origin net.Addr, from string, to []string, data []byte) error {
+		metrics.Recipients.Observe(float64(len(to)))
+		metrics.MessageSize.Observe(float64(len(data)))
+		return relay.Reply(client.Send(origin, from, to, data))
+	}
+}
+
+// server creates the server of the primary listener.
+func server() (*smtpd.Server, error) {
+	return newServer(listenerSettings{
+		addr:     *addr,
+		startTLS: *startTLS,
+		onlyTLS:  *onlyTLS,
+		policies: policies,
+	})
+}
+
+// newServer creates a server with the given listener settings.
+func newServer(l listenerSettings) (srv *smtpd.Server, err error) {
 	authMechs := make(map[string]bool)
-	if *user != "" && len(bcryptHash) > 0 && len(password) == 0 {
+	if (*user != "" && len(bcryptHash) > 0 || users != nil) &&
+		len(password) == 0 {
 		authMechs["CRAM-MD5"] = false
 	}
+	authentication := auth.New(
+		allowNets,
+		denyNets,
+		trustedNets,
+		*user,
+		bcryptHash,
+		password,
+		users,
+		certUsers,
+	)
 	srv = &smtpd.Server{
-		Addr:         *addr,
-		Handler:      relayClient.Send,
-		Appname:      *name,
-		Hostname:     *host,
-		TLSRequired:  *startTLS,
-		TLSListener:  *onlyTLS,
-		AuthRequired: ipMap != nil || *user != "",
-		AuthHandler:  auth.New(ipMap, *user, bcryptHash, password).Handler,
-		AuthMechs:    authMechs,
-	}
-	if *certFile != "" && *keyFile != "" {
-		keyPass := os.Getenv("TLS_KEY_PASS")
-		if keyPass != "" {
-			err = srv.ConfigureTLSWithPassphrase(*certFile, *keyFile, keyPass)
-		} else {
-			err = srv.ConfigureTLS(*certFile, *keyFile)
+		Addr:        l.addr,
+		Handler:     sender(relayClient),
+		Appname:     *name,
+		Hostname:    *host,
+		TLSRequired: l.startTLS,
+		TLSListener: l.onlyTLS,
+		AuthRequired: allowNets != nil || denyNets != nil ||
+			trustedNets != nil || *user != "" || users != nil ||
+			clientCAs != nil,
+		AuthHandler: authentication.Handler,
+		AuthMechs:   authMechs,
+	}
+	if l.requireAuth != nil {
+		srv.AuthRequired = *l.requireAuth
+	}
+	if *checkIPs {
+		srv.HandlerConnect = authentication.HandlerConnect
+	}
+	if trustedNets != nil {
+		srv.AuthTrusted = authentication.Trusted
+	}
+	// Reject denied senders and recipients before the email data is sent:
+	handlers := l.policies
+	if globalPolicy != nil {
+		handlers = policy.Global(globalPolicy, l.policies)
+	}
+	if handlers != nil {
+		srv.HandlerMail = handlers.HandlerMail
+		srv.HandlerRcpt = handlers.HandlerRcpt
+	}
+	if *keyFile != "" {
+		var reloader *certificate.Reloader
+		reloader, err = certificate.New(
+			*certFile,
+			*keyFile,
+			os.Getenv("TLS_KEY_PASS"),
+		)
+		if err == nil {
+			srv.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+			srv.HandlerTLS = session.HandlerTLS
+			err = configureTLS(srv.TLSConfig)
+		}
+		if err == nil && clientCAs != nil {
+			srv.TLSConfig.ClientCAs = clientCAs
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if *clientReq {
+				srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			srv.AuthCertificate = authentication.HandlerCertificate
 		}
 	}
 	return
 }
 
+// servers creates the servers of the primary and the additional listeners.
+func servers() ([]*smtpd.Server, error) {
+	srv, err := server()
+	if err != nil {
+		return nil, err
+	}
+	srvs := []*smtpd.Server{srv}
+	for _, l := range listeners {
+		srv, err = newServer(l)
+		if err != nil {
+			return nil, errors.New("Listener " + l.addr + ": " + err.Error())
+		}
+		srvs = append(srvs, srv)
+	}
+	return srvs, nil
+}
+
+// listen creates the listener for the given server, annotating connections
+// with session state.
+func listen(srv *smtpd.Server) (*handoff.Listener, error) {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return handoff.New(session.NewListener(metrics.NewListener(ln))), nil
+}
+
+// listenAll creates the listeners for the given servers.
+func listenAll(srvs []*smtpd.Server) ([]*handoff.Listener, error) {
+	lns := make([]*handoff.Listener, 0, len(srvs))
+	for _, srv := range srvs {
+		ln, err := listen(srv)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// view returns a view of the given listener for the given server, which
+// accepts connections until the server is replaced or shut down.
+// Defaults are set like in smtpd.Server.ListenAndServe.
+func view(srv *smtpd.Server, ln *handoff.Listener) net.Listener {
+	if srv.Hostname == "" {
+		srv.Hostname, _ = os.Hostname()
+	}
+	if srv.Timeout == 0 {
+		srv.Timeout = 5 * time.Minute
+	}
+	v := ln.View()
+	if srv.TLSConfig != nil && srv.TLSListener {
+		v = tls.NewListener(v, srv.TLSConfig)
+	}
+	return v
+}
+
+// healthy returns an error if the SMTP listener is not accepting connections.
+func healthy() error {
+	if atomic.LoadInt32(&serving) == 0 {
+		return errors.New("SMTP listener not accepting connections")
+	}
+	return nil
+}
+
+// ready returns an error if the relay is not able to send emails.
+func ready() error {
+	if err := healthy(); err != nil {
+		return err
+	}
+	settingsMu.RLock()
+	client, creds, check := relayClient, awsCredentials, *checkAPI
+	settingsMu.RUnlock()
+	if _, err := creds.Get(); err != nil {
+		return errors.New("AWS credentials: " + err.Error())
+	}
+	if checker, ok := client.(relay.Checker); ok && check {
+		if err := checker.Check(); err != nil {
+			return errors.New("Relay API: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// probe returns an HTTP handler responding with the result of the given check.
+func probe(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+// admin returns the HTTP handler of the admin listener.
+func admin() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", probe(healthy))
+	mux.Handle("/readyz", probe(ready))
+	return mux
+}
+
+// listenAdmin starts the admin HTTP server if an address is configured.
+func listenAdmin() error {
+	if *adminAddr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", *adminAddr)
+	if err != nil {
+		return errors.New("Admin listener: " + err.Error())
+	}
+	go http.Serve(ln, admin())
+	return nil
+}
+
+func parseEmailTags(s string) (map[string]string, error) {
+	return parsePairs(s, "email tag")
+}
+
+// parsePairs parses a comma-separated list of name=value pairs.
+// kind describes the pairs in error messages.
+func parsePairs(s string, kind string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	if s == "" {
+		return pairs, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("Invalid " + kind + ": " + pair)
+		}
+		pairs[kv[0]] = kv[1]
+	}
+	return pairs, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurveIDs = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// parseList parses a comma-separated list of values.
+func parseList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	return names
+}
+
+// parseTLSVersion parses a TLS version, returning 0 for an empty string.
+func parseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	version, ok := tlsVersions[s]
+	if !ok {
+		return 0, errors.New("Invalid TLS version: " + s)
+	}
+	return version, nil
+}
+
+// parseCipherSuites parses a comma-separated list of TLS cipher suite names.
+func parseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ids := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(s, ",") {
+		id, ok := ids[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.New("Invalid TLS cipher suite: " + name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// parseCurves parses a comma-separated list of TLS curve names.
+func parseCurves(s string) ([]tls.CurveID, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var curves []tls.CurveID
+	for _, name := range strings.Split(s, ",") {
+		curve, ok := tlsCurveIDs[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.New("Invalid TLS curve: " + name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+// configureTLS applies the TLS version, cipher suite and curve options to the
+// given TLS config.
+func configureTLS(config *tls.Config) (err error) {
+	config.MinVersion, err = parseTLSVersion(*tlsMin)
+	if err != nil {
+		return errors.New("TLS min version: " + err.Error())
+	}
+	config.MaxVersion, err = parseTLSVersion(*tlsMax)
+	if err != nil {
+		return errors.New("TLS max version: " + err.Error())
+	}
+	if config.MinVersion != 0 && config.MaxVersion != 0 &&
+		config.MinVersion > config.MaxVersion {
+		return errors.New("TLS min version exceeds max version")
+	}
+	config.CipherSuites, err = parseCipherSuites(*tlsCiphers)
+	if err != nil {
+		return errors.New("TLS ciphers: " + err.Error())
+	}
+	config.CurvePreferences, err = parseCurves(*tlsCurves)
+	if err != nil {
+		return errors.New("TLS curves: " + err.Error())
+	}
+	return nil
+}
+
+// readCertPool reads PEM encoded certificates from the given file.
+func readCertPool(name string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("No valid certificates in " + name)
+	}
+	return pool, nil
+}
+
+// newRelayClient creates a relay client for the given relay API.
+// regionNames optionally lists the SES regions in failover order, which are
+// only supported by the ses relay API.
+// configs optionally override the AWS configuration, e.g. the region.
+func newRelayClient(
+	api string,
+	setName *string,
+	regionNames []string,
+	allowFromRegExp *regexp.Regexp,
+	denyToRegExp *regexp.Regexp,
+	configs ...*aws.Config,
+) (relay.Client, error) {
+	if len(regionNames) > 0 && api != "ses" {
+		return nil, errors.New("Regions are not supported by relay API: " + api)
+	}
+	switch api {
+	case "pinpoint":
+		tags, err := parseEmailTags(*emailTags)
+		if err != nil {
+			return nil, err
+		}
+		return pinpointrelay.New(
+			setName,
+			tags,
+			feedbackTo,
+			parseList(*replyTo),
+			allowFromRegExp,
+			denyToRegExp,
+			configs...,
+		)
+	case "ses":
+		return sesrelay.New(
+			setName,
+			allowFromRegExp,
+			denyToRegExp,
+			regionNames,
+			configs...,
+		)
+	case "sesv2":
+		tags, err := parseEmailTags(*emailTags)
+		if err != nil {
+			return nil, err
+		}
+		listParts := strings.SplitN(*listOpts, ":", 2)
+		contactList, topic := listParts[0], ""
+		if len(listParts) > 1 {
+			topic = listParts[1]
+		}
+		return sesv2relay.New(
+			setName,
+			fromArn,
+			tags,
+			&contactList,
+			&topic,
+			allowFromRegExp,
+			denyToRegExp,
+			configs...,
+		)
+	}
+	return nil, errors.New("Invalid relay API: " + api)
+}
+
+// awsConfig returns an AWS configuration with the given endpoint URL, region
+// and maximum number of request retries, which are unset if empty or negative.
+func awsConfig(endpointURL string, region string, retries int) *aws.Config {
+	c := aws.NewConfig()
+	if endpointURL != "" {
+		c.WithEndpoint(endpointURL)
+	}
+	if region != "" {
+		c.WithRegion(region)
+	}
+	if retries >= 0 {
+		c.WithMaxRetries(retries)
+	}
+	return c
+}
+
+// assumeRoleConfig returns an AWS configuration with the credentials of the
+// given IAM role, which are retrieved via STS AssumeRole, cached and refreshed
+// before they expire.
+func assumeRoleConfig(
+	sess *awssession.Session,
+	roleArn string,
+	externalID string,
+) *aws.Config {
+	creds := stscreds.NewCredentials(
+		sess,
+		roleArn,
+		func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = "aws-smtp-relay"
+			p.ExpiryWindow = time.Minute
+			if externalID != "" {
+				p.ExternalID = &externalID
+			}
+		},
+	)
+	return aws.NewConfig().WithCredentials(creds)
+}
+
+// newRoutes creates the routes of the router relay from the given config file
+// routes, which default to the relay API, configuration set and AWS options.
+func newRoutes(
+	fileRoutes []config.Route,
+	allowFromRegExp *regexp.Regexp,
+	denyToRegExp *regexp.Regexp,
+	baseConfig *aws.Config,
+) ([]routerrelay.Route, error) {
+	routes := make([]routerrelay.Route, len(fileRoutes))
+	var sess *awssession.Session
+	for i, r := range fileRoutes {
+		api := r.RelayAPI
+		if api == "" {
+			api = *relayAPI
+		}
+		routeSetName := r.ConfigurationSet
+		if routeSetName == nil {
+			routeSetName = setName
+		}
+		regionNames := parseList(*regions)
+		if r.Region != "" {
+			regionNames = nil
+		}
+		retries := -1
+		if r.MaxRetries != nil {
+			retries = *r.MaxRetries
+		}
+		configs := []*aws.Config{
+			baseConfig,
+			awsConfig(r.Endpoint, r.Region, retries),
+		}
+		if r.RoleArn != "" {
+			if sess == nil {
+				// Only the region applies to STS, as the endpoint and retries
+				// configure the relay API:
+				var err error
+				sess, err = awssession.NewSession(
+					aws.NewConfig().WithRegion(aws.StringValue(baseConfig.Region)),
+				)
+				if err != nil {
+					return nil, fmt.Errorf("routes[%d]: %s", i, err)
+				}
+			}
+			configs = append(
+				configs,
+				assumeRoleConfig(sess, r.RoleArn, r.ExternalID),
+			)
+		}
+		client, err := newRelayClient(
+			api,
+			routeSetName,
+			regionNames,
+			allowFromRegExp,
+			denyToRegExp,
+			configs...,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d]: %s", i, err)
+		}
+		routes[i] = routerrelay.Route{
+			SenderDomain:    r.SenderDomain,
+			User:            r.User,
+			RecipientDomain: r.RecipientDomain,
+			Headers:         r.Headers,
+			Client:          client,
+		}
+	}
+	return routes, nil
+}
+
 func configure() error {
 	var allowFromRegExp *regexp.Regexp
 	var denyToRegExp *regexp.Regexp
+	var file *config.File
 	var err error
+	if *configFile != "" {
+		file, err = config.Read(*configFile, configKeys, configEnv)
+		if err == nil {
+			err = file.Apply(flag.CommandLine, overrides)
+		}
+		if err != nil {
+			return errors.New("Config file: " + err.Error())
+		}
+	}
 	if *allowFrom != "" {
 		allowFromRegExp, err = regexp.Compile(*allowFrom)
 		if err != nil {
@@ -79,33 +789,365 @@ func configure() error {
 			return errors.New("Denied recipient emails: " + err.Error())
 		}
 	}
-	switch *relayAPI {
-	case "pinpoint":
-		relayClient = pinpointrelay.New(setName, allowFromRegExp, denyToRegExp)
-	case "ses":
-		relayClient = sesrelay.New(setName, allowFromRegExp, denyToRegExp)
-	default:
-		return errors.New("Invalid relay API: " + *relayAPI)
+	globalPolicy = nil
+	if allowFromRegExp != nil || denyToRegExp != nil {
+		globalPolicy = &policy.Policy{
+			AllowFrom: allowFromRegExp,
+			DenyTo:    denyToRegExp,
+		}
+	}
+	baseConfig := awsConfig(*endpoint, *awsRegion, *maxRetries)
+	relayClient, err = newRelayClient(
+		*relayAPI,
+		setName,
+		parseList(*regions),
+		allowFromRegExp,
+		denyToRegExp,
+		baseConfig,
+	)
+	if err != nil {
+		return err
+	}
+	if file != nil && len(file.Routes) > 0 {
+		routes, err := newRoutes(
+			file.Routes,
+			allowFromRegExp,
+			denyToRegExp,
+			baseConfig,
+		)
+		if err != nil {
+			return errors.New("Config file: " + err.Error())
+		}
+		relayClient = routerrelay.New(routes, relayClient)
+	}
+	if *rateLimit != "" {
+		var rate float64
+		if *rateLimit != "quota" {
+			rate, err = strconv.ParseFloat(*rateLimit, 64)
+			if err == nil && rate <= 0 {
+				err = errors.New("must be positive")
+			}
+			if err != nil {
+				return errors.New("Rate limit: " + err.Error())
+			}
+		}
+		relayClient = ratelimitrelay.New(relayClient, rate, *rateWait)
 	}
-	if *ips != "" {
-		ipMap = make(map[string]bool)
-		for _, ip := range strings.Split(*ips, ",") {
-			ipMap[ip] = true
+	if *spoolDir != "" {
+		relayClient, err = spoolrelay.New(relayClient, *spoolDir, *spoolAge)
+		if err != nil {
+			return errors.New("Spool directory: " + err.Error())
 		}
 	}
+	allowNets, err = network.ParseList(*ips)
+	if err != nil {
+		return errors.New("Allowed client IPs: " + err.Error())
+	}
+	denyNets, err = network.ParseList(*denyIPs)
+	if err != nil {
+		return errors.New("Denied client IPs: " + err.Error())
+	}
+	trustedNets, err = network.ParseList(*trustedIPs)
+	if err != nil {
+		return errors.New("Trusted client IPs: " + err.Error())
+	}
+	users = nil
+	if *usersFile != "" {
+		users, err = auth.ReadUsers(*usersFile)
+		if err != nil {
+			return errors.New("Users file: " + err.Error())
+		}
+	}
+	clientCAs = nil
+	certUsers = nil
+	if *clientCA != "" {
+		clientCAs, err = readCertPool(*clientCA)
+		if err != nil {
+			return errors.New("TLS client CA file: " + err.Error())
+		}
+		certUsers, err = parsePairs(*clientMap, "client certificate user")
+		if err != nil {
+			return errors.New("TLS client users: " + err.Error())
+		}
+	}
+	policies = nil
+	if *policyFile != "" {
+		policies, err = policy.Read(*policyFile)
+		if err != nil {
+			return errors.New("Policies file: " + err.Error())
+		}
+	} else if file != nil && file.Policies != nil {
+		policies, err = policy.New(file.Policies.Users, file.Policies.IPs)
+		if err != nil {
+			return errors.New("Config file: policies: " + err.Error())
+		}
+	}
+	listeners = nil
+	if file != nil {
+		for _, l := range file.Listeners {
+			if l.RequireAuth != nil && *l.RequireAuth && *user == "" &&
+				users == nil && clientCAs == nil && allowNets == nil {
+				return errors.New(
+					"Config file: listener " + l.Listen +
+						": requireAuth needs users, client certificates or allowed IPs",
+				)
+			}
+			settings := listenerSettings{
+				addr:        l.Listen,
+				startTLS:    l.StartTLS,
+				onlyTLS:     l.OnlyTLS,
+				requireAuth: l.RequireAuth,
+				policies:    policies,
+			}
+			if l.Policies != nil {
+				settings.policies, err = policy.New(l.Policies.Users, l.Policies.IPs)
+				if err != nil {
+					return errors.New(
+						"Config file: listener " + l.Listen + ": policies: " + err.Error(),
+					)
+				}
+			}
+			listeners = append(listeners, settings)
+		}
+	}
+	sess, err := awssession.NewSession()
+	if err != nil {
+		return errors.New("AWS session: " + err.Error())
+	}
+	awsCredentials = sess.Config.Credentials
 	bcryptHash = []byte(os.Getenv("BCRYPT_HASH"))
 	password = []byte(os.Getenv("PASSWORD"))
 	return nil
 }
 
+// reload re-reads the configuration and creates servers with the new settings
+// for the listen addresses of the given servers, which cannot be changed.
+// On error, the previous settings, flags and environment variables are kept.
+func reload(current []*smtpd.Server) (srvs []*smtpd.Server, err error) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	previous := currentSettings()
+	err = configure()
+	if err == nil {
+		srvs, err = servers()
+	}
+	if err == nil && len(srvs) != len(current) {
+		err = errors.New("Listeners cannot be added or removed without a restart")
+	}
+	for i := 0; err == nil && i < len(srvs); i++ {
+		if srvs[i].Addr != current[i].Addr {
+			err = errors.New(
+				"Listen address " + current[i].Addr +
+					" cannot be changed without a restart",
+			)
+		}
+	}
+	if err != nil {
+		previous.restore()
+		srvs = nil
+	}
+	return
+}
+
+// runSpool delivers the emails of the given client, if it is a spool client,
+// once the previous delivery run is done and until stop is closed.
+// Returns a channel which is closed when the delivery run is done.
+func runSpool(
+	client relay.Client,
+	previous <-chan struct{},
+	stop <-chan struct{},
+) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-previous
+		spoolClient, ok := client.(spoolrelay.Client)
+		if !ok {
+			return
+		}
+		select {
+		case <-stop:
+		default:
+			spoolClient.Run(stop)
+		}
+	}()
+	return done
+}
+
+type reloadEntry struct {
+	Time     time.Time
+	Signal   string
+	Sessions int
+	Error    *string
+}
+
+type shutdownEntry struct {
+	Time     time.Time
+	Signal   string
+	Sessions int
+	Drained  int
+	Aborted  int
+	Duration string
+	Error    *string
+}
+
+// serve runs the servers until one fails or a termination signal is received.
+// On SIGHUP, the configuration is reloaded and new servers accept the
+// connections, while sessions in progress keep their previous settings.
+// On termination signal, the servers stop accepting connections and wait for
+// open sessions and spool deliveries to complete within the shutdown timeout,
+// then abort the remaining sessions and log a summary.
+func serve(
+	srvs []*smtpd.Server,
+	lns []*handoff.Listener,
+	signals <-chan os.Signal,
+) error {
+	for _, ln := range lns {
+		defer ln.Close()
+	}
+	closed := make(chan struct{})
+	close(closed)
+	stop := make(chan struct{})
+	spoolDone := runSpool(relayClient, closed, stop)
+	served := make(chan error, 1)
+	views := make([]net.Listener, len(srvs))
+	start := func() {
+		for i, srv := range srvs {
+			views[i] = view(srv, lns[i])
+			go func(srv *smtpd.Server, v net.Listener) {
+				err := srv.Serve(v)
+				if err != handoff.ErrClosed && err != smtpd.ErrServerClosed {
+					select {
+					case served <- err:
+					default:
+					}
+				}
+			}(srv, views[i])
+		}
+	}
+	start()
+	var previous []*smtpd.Server
+	atomic.StoreInt32(&serving, 1)
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case err := <-served:
+			atomic.StoreInt32(&serving, 0)
+			close(stop)
+			return err
+		case sig = <-signals:
+		}
+		if sig != syscall.SIGHUP {
+			break
+		}
+		sig = nil
+		next, err := reload(srvs)
+		entry := &reloadEntry{
+			Time:   time.Now().UTC(),
+			Signal: syscall.SIGHUP.String(),
+		}
+		if err != nil {
+			errString := err.Error()
+			entry.Error = &errString
+		} else {
+			for _, v := range views {
+				v.Close()
+			}
+			kept := previous[:0]
+			for _, s := range append(previous, srvs...) {
+				if n := s.OpenSessions(); n > 0 {
+					entry.Sessions += n
+					kept = append(kept, s)
+				}
+			}
+			previous = kept
+			srvs = next
+			start()
+			close(stop)
+			stop = make(chan struct{})
+			spoolDone = runSpool(relayClient, spoolDone, stop)
+		}
+		b, _ := json.Marshal(entry)
+		fmt.Println(string(b))
+	}
+	atomic.StoreInt32(&serving, 0)
+	// Stop accepting new connections before draining the open sessions:
+	for _, ln := range lns {
+		ln.Close()
+	}
+	begin := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTime)
+	defer cancel()
+	all := append(previous, srvs...)
+	sessions := 0
+	for _, s := range all {
+		sessions += s.OpenSessions()
+	}
+	close(stop)
+	errs := make(chan error, len(all))
+	for _, s := range all {
+		go func(s *smtpd.Server) {
+			errs <- s.Shutdown(ctx)
+		}(s)
+	}
+	var err error
+	for range all {
+		if shutdownErr := <-errs; shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	if err == nil {
+		select {
+		case <-spoolDone:
+		case <-ctx.Done():
+			err = errors.New("Spool delivery: " + ctx.Err().Error())
+		}
+	}
+	aborted := 0
+	for _, s := range all {
+		aborted += s.OpenSessions()
+		s.Close()
+	}
+	entry := &shutdownEntry{
+		Time:     time.Now().UTC(),
+		Signal:   sig.String(),
+		Sessions: sessions,
+		Drained:  sessions - aborted,
+		Aborted:  aborted,
+		Duration: time.Since(begin).String(),
+	}
+	if err != nil {
+		errString := err.Error()
+		entry.Error = &errString
+	}
+	b, _ := json.Marshal(entry)
+	fmt.Println(string(b))
+	return nil
+}
+
 func main() {
 	flag.Parse()
-	var srv *smtpd.Server
+	overrides = config.Overrides(flag.CommandLine, configEnv)
+	var srvs []*smtpd.Server
+	var lns []*handoff.Listener
 	err := configure()
 	if err == nil {
-		srv, err = server()
+		srvs, err = servers()
+		if err == nil {
+			lns, err = listenAll(srvs)
+		}
+		if err == nil {
+			err = listenAdmin()
+		}
 		if err == nil {
-			err = srv.ListenAndServe()
+			signals := make(chan os.Signal, 1)
+			signal.Notify(
+				signals,
+				syscall.SIGTERM,
+				syscall.SIGINT,
+				syscall.SIGHUP,
+			)
+			err = serve(srvs, lns, signals)
 		}
 	}
 	if err != nil {
@@ -1,14 +1,45 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
 	"os"
 	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/blueimp/aws-smtp-relay/internal/handoff"
+	"github.com/blueimp/aws-smtp-relay/internal/metrics"
+	"github.com/blueimp/aws-smtp-relay/internal/policy"
+	"github.com/blueimp/aws-smtp-relay/internal/relay"
 	pinpointrelay "github.com/blueimp/aws-smtp-relay/internal/relay/pinpoint"
+	ratelimitrelay "github.com/blueimp/aws-smtp-relay/internal/relay/ratelimit"
+	routerrelay "github.com/blueimp/aws-smtp-relay/internal/relay/router"
 	sesrelay "github.com/blueimp/aws-smtp-relay/internal/relay/ses"
+	sesv2relay "github.com/blueimp/aws-smtp-relay/internal/relay/sesv2"
+	spoolrelay "github.com/blueimp/aws-smtp-relay/internal/relay/spool"
+	"github.com/blueimp/aws-smtp-relay/internal/session"
+	"github.com/blueimp/aws-smtp-relay/internal/smtpd"
 )
 
 const certPEM = `-----BEGIN CERTIFICATE-----
@@ -134,18 +165,58 @@ func resetHelper() {
 	*host = ""
 	*certFile = ""
 	*keyFile = ""
+	*clientCA = ""
+	*clientReq = false
+	*clientMap = ""
+	*tlsMin = ""
+	*tlsMax = ""
+	*tlsCiphers = ""
+	*tlsCurves = ""
 	*startTLS = false
 	*onlyTLS = false
 	*relayAPI = "ses"
 	*setName = ""
+	*fromArn = ""
+	*emailTags = ""
+	*listOpts = ""
+	*feedbackTo = ""
+	*replyTo = ""
+	*regions = ""
+	*endpoint = ""
+	*awsRegion = ""
+	*maxRetries = -1
 	*ips = ""
+	*denyIPs = ""
+	*trustedIPs = ""
+	*checkIPs = false
 	*user = ""
+	*usersFile = ""
 	*allowFrom = ""
 	*denyTo = ""
-	ipMap = nil
+	*rateLimit = ""
+	*rateWait = 0
+	*spoolDir = ""
+	*spoolAge = 24 * time.Hour
+	*policyFile = ""
+	*adminAddr = ""
+	*checkAPI = false
+	*drainTime = 30 * time.Second
+	*configFile = ""
+	allowNets = nil
+	denyNets = nil
+	trustedNets = nil
 	bcryptHash = nil
 	password = nil
+	users = nil
+	clientCAs = nil
+	certUsers = nil
+	policies = nil
+	globalPolicy = nil
+	listeners = nil
 	relayClient = nil
+	awsCredentials = nil
+	overrides = nil
+	atomic.StoreInt32(&serving, 0)
 	os.Unsetenv("BCRYPT_HASH")
 	os.Unsetenv("PASSWORD")
 	os.Unsetenv("TLS_KEY_PASS")
@@ -166,8 +237,8 @@ func TestConfigure(t *testing.T) {
 	if *ips != "" {
 		t.Errorf("Unexpected IPs string: %s", *ips)
 	}
-	if len(ipMap) != 0 {
-		t.Errorf("Unexpected IP map size: %d", len(ipMap))
+	if len(allowNets) != 0 {
+		t.Errorf("Unexpected allowed networks size: %d", len(allowNets))
 	}
 	_, ok := interface{}(relayClient).(sesrelay.Client)
 	if !ok {
@@ -191,6 +262,63 @@ func TestConfigureWithPinpointRelay(t *testing.T) {
 	}
 }
 
+func TestConfigureWithSESV2Relay(t *testing.T) {
+	resetHelper()
+	*relayAPI = "sesv2"
+	*emailTags = "a=1,b=2"
+	*listOpts = "list:topic"
+	err := configure()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	_, ok := interface{}(relayClient).(sesv2relay.Client)
+	if !ok {
+		t.Error("Unexpected: relayClient function is not an sesv2relay.Client")
+	}
+}
+
+func TestConfigureWithPinpointFields(t *testing.T) {
+	resetHelper()
+	*relayAPI = "pinpoint"
+	*emailTags = "a=1,b=2"
+	*feedbackTo = "bounces@example.org"
+	*replyTo = "support@example.org, sales@example.org"
+	err := configure()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, ok := relayClient.(pinpointrelay.Client); !ok {
+		t.Error("Unexpected: relayClient is not a pinpointrelay.Client")
+	}
+}
+
+func TestConfigureWithInvalidEmailTags(t *testing.T) {
+	for _, api := range []string{"sesv2", "pinpoint"} {
+		resetHelper()
+		*relayAPI = api
+		*emailTags = "a=1,b"
+		err := configure()
+		if err == nil {
+			t.Errorf("Unexpected nil error for relay API %s", api)
+		}
+	}
+}
+
+func TestParseEmailTags(t *testing.T) {
+	tags, err := parseEmailTags("a=1,b=x=y,c=")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	expectedTags := map[string]string{"a": "1", "b": "x=y", "c": ""}
+	if !reflect.DeepEqual(tags, expectedTags) {
+		t.Errorf("Unexpected tags: %v. Expected: %v", tags, expectedTags)
+	}
+	_, err = parseEmailTags("=1")
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
 func TestConfigureWithInvalidRelay(t *testing.T) {
 	resetHelper()
 	*relayAPI = "invalid"
@@ -203,6 +331,64 @@ func TestConfigureWithInvalidRelay(t *testing.T) {
 	}
 }
 
+func TestConfigureWithRateLimit(t *testing.T) {
+	for _, limit := range []string{"14", "0.5", "quota"} {
+		resetHelper()
+		*rateLimit = limit
+		*rateWait = time.Second
+		if err := configure(); err != nil {
+			t.Errorf("Unexpected error for rate limit %s: %s", limit, err)
+		}
+		if _, ok := relayClient.(ratelimitrelay.Client); !ok {
+			t.Error("Unexpected: relayClient is not a ratelimitrelay.Client")
+		}
+	}
+}
+
+func TestConfigureWithInvalidRateLimit(t *testing.T) {
+	for _, limit := range []string{"invalid", "0", "-1"} {
+		resetHelper()
+		*rateLimit = limit
+		if err := configure(); err == nil {
+			t.Errorf("Unexpected nil error for rate limit %s", limit)
+		}
+	}
+}
+
+func TestConfigureWithSpool(t *testing.T) {
+	resetHelper()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Errorf("Unexpected temp dir creation error: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	*spoolDir = dir
+	err = configure()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	_, ok := interface{}(relayClient).(spoolrelay.Client)
+	if !ok {
+		t.Error("Unexpected: relayClient function is not a spoolrelay.Client")
+	}
+}
+
+func TestConfigureWithInvalidSpool(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile("")
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*spoolDir = *file
+	err = configure()
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
 func TestConfigureWithBcryptHash(t *testing.T) {
 	resetHelper()
 	os.Setenv("BCRYPT_HASH", sampleHash)
@@ -227,6 +413,404 @@ func TestConfigureWithPassword(t *testing.T) {
 	}
 }
 
+func TestConfigureWithUsersFile(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile("alice:" + sampleHash + "\n")
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*usersFile = *file
+	err = configure()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if string(users["alice"]) != sampleHash {
+		t.Errorf("Unexpected users: %v", users)
+	}
+}
+
+func TestConfigureWithInvalidUsersFile(t *testing.T) {
+	resetHelper()
+	*usersFile = "/nonexistent/users"
+	err := configure()
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestConfigureWithPolicyFile(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile(`{"Users": {"alice": {"MaxRecipients": 1}}}`)
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*policyFile = *file
+	err = configure()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if policies == nil {
+		t.Error("Unexpected nil policies")
+	}
+}
+
+func TestConfigureWithInvalidPolicyFile(t *testing.T) {
+	resetHelper()
+	*policyFile = "/nonexistent/policies.json"
+	err := configure()
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestConfigKeys(t *testing.T) {
+	keys := make(map[string]bool)
+	for _, name := range configKeys {
+		keys[name] = true
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" && !strings.HasPrefix(f.Name, "test.") &&
+			!keys[f.Name] {
+			t.Errorf("Unexpected missing config key for flag: %s", f.Name)
+		}
+	})
+}
+
+func TestConfigureWithConfigFile(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile(`
+relayAPI: sesv2
+denyIPs: [10.0.1.0/24]
+spoolAge: 1h
+bcryptHash: ` + sampleHash + `
+policies:
+  users:
+    alice:
+      maxRecipients: 1
+`)
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*configFile = *file
+	err = configure()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, ok := relayClient.(sesv2relay.Client); !ok {
+		t.Error("Unexpected: relayClient is not an sesv2relay.Client")
+	}
+	if len(denyNets) != 1 {
+		t.Errorf("Unexpected denied networks size: %d", len(denyNets))
+	}
+	if *spoolAge != time.Hour {
+		t.Errorf("Unexpected spool age: %s", *spoolAge)
+	}
+	if string(bcryptHash) != sampleHash {
+		t.Errorf("Unexpected bcrypt hash: %s", bcryptHash)
+	}
+	if policies == nil {
+		t.Error("Unexpected nil policies")
+	}
+}
+
+func TestConfigureWithInvalidConfigFile(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile("relayApi: sesv2\n")
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*configFile = *file
+	err = configure()
+	expected := `Config file: line 1: unknown key "relayApi"`
+	if err == nil || err.Error() != expected {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, expected)
+	}
+}
+
+func TestConfigureWithInvalidConfigPolicies(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile("policies:\n  ips:\n    invalid: {}\n")
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*configFile = *file
+	err = configure()
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestConfigureWithRegions(t *testing.T) {
+	resetHelper()
+	*regions = "us-east-1, us-west-2"
+	err := configure()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, ok := relayClient.(sesrelay.Client); !ok {
+		t.Error("Unexpected: relayClient is not an sesrelay.Client")
+	}
+	names := parseList(*regions)
+	if len(names) != 2 || names[0] != "us-east-1" || names[1] != "us-west-2" {
+		t.Errorf("Unexpected regions: %v", names)
+	}
+}
+
+func TestConfigureWithRegionsAndOtherRelay(t *testing.T) {
+	for _, api := range []string{"pinpoint", "sesv2"} {
+		resetHelper()
+		*relayAPI = api
+		*regions = "us-east-1, us-west-2"
+		err := configure()
+		if err == nil {
+			t.Errorf("Unexpected nil error for relay API: %s", api)
+		}
+	}
+}
+
+func TestConfigureWithConfigRoutes(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile(`
+routes:
+  - senderDomain: example.org
+    relayAPI: pinpoint
+    region: eu-west-1
+  - user: alice
+    configurationSet: marketing
+    roleArn: arn:aws:iam::123456789012:role/relay
+    externalId: alice
+`)
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*configFile = *file
+	err = configure()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, ok := relayClient.(routerrelay.Client); !ok {
+		t.Error("Unexpected: relayClient is not a routerrelay.Client")
+	}
+}
+
+func TestConfigureWithInvalidConfigRoutes(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile("routes:\n  - relayAPI: invalid\n")
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*configFile = *file
+	err = configure()
+	expected := "Config file: routes[0]: Invalid relay API: invalid"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, expected)
+	}
+}
+
+func TestConfigureWithRegionsAndOtherRelayRoutes(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile(`
+regions: [us-east-1, us-west-2]
+routes:
+  - relayAPI: sesv2
+    region: eu-west-1
+  - relayAPI: pinpoint
+`)
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*configFile = *file
+	err = configure()
+	expected := "Config file: routes[1]: " +
+		"Regions are not supported by relay API: pinpoint"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Unexpected error: %v. Expected: %s", err, expected)
+	}
+}
+
+func TestAWSConfig(t *testing.T) {
+	c := awsConfig("http://localhost:4566", "eu-west-1", 0)
+	if aws.StringValue(c.Endpoint) != "http://localhost:4566" {
+		t.Errorf("Unexpected endpoint: %s", aws.StringValue(c.Endpoint))
+	}
+	if aws.StringValue(c.Region) != "eu-west-1" {
+		t.Errorf("Unexpected region: %s", aws.StringValue(c.Region))
+	}
+	if aws.IntValue(c.MaxRetries) != 0 || c.MaxRetries == nil {
+		t.Errorf("Unexpected max retries: %v", c.MaxRetries)
+	}
+	c = awsConfig("", "", -1)
+	if c.Endpoint != nil || c.Region != nil || c.MaxRetries != nil {
+		t.Errorf("Unexpected config: %+v", c)
+	}
+}
+
+// stsHandler returns an HTTP handler implementing the STS AssumeRole API,
+// which counts the requests, stores the parameters of the last request and
+// replies with the credentials "AKID", "SECRET" and "TOKEN".
+func stsHandler(calls *int, form *url.Values) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*calls++
+			r.ParseForm()
+			*form = r.PostForm
+			fmt.Fprintf(w, `<AssumeRoleResponse>
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>AKID</AccessKeyId>
+      <SecretAccessKey>SECRET</SecretAccessKey>
+      <SessionToken>TOKEN</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+		},
+	)
+}
+
+func TestAssumeRoleConfig(t *testing.T) {
+	var calls int
+	var form url.Values
+	srv := httptest.NewServer(stsHandler(&calls, &form))
+	defer srv.Close()
+	sess := awssession.Must(awssession.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("ID", "SECRET", ""),
+	}))
+	roleArn := "arn:aws:iam::123456789012:role/relay"
+	awsConfig := assumeRoleConfig(sess, roleArn, "alice")
+	for i := 0; i < 2; i++ {
+		value, err := awsConfig.Credentials.Get()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if value.AccessKeyID != "AKID" || value.SessionToken != "TOKEN" {
+			t.Errorf("Unexpected credentials: %+v", value)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Unexpected number of AssumeRole calls: %d. Expected: %d", calls, 1)
+	}
+	if form.Get("RoleArn") != roleArn || form.Get("ExternalId") != "alice" ||
+		form.Get("RoleSessionName") != "aws-smtp-relay" {
+		t.Errorf("Unexpected AssumeRole request: %v", form)
+	}
+}
+
+func TestConfigureWithConfigRoutesAssumingRole(t *testing.T) {
+	var stsCalls int
+	var stsForm url.Values
+	var stsHost string
+	handler := stsHandler(&stsCalls, &stsForm)
+	sts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			stsHost = r.Host
+			handler.ServeHTTP(w, r)
+		},
+	))
+	defer sts.Close()
+	var authorization string
+	ses := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			w.Header().Set("Content-Type", "text/xml")
+			fmt.Fprint(w, `<SendRawEmailResponse>
+  <SendRawEmailResult><MessageId>1</MessageId></SendRawEmailResult>
+</SendRawEmailResponse>`)
+		},
+	))
+	defer ses.Close()
+	originalClient := http.DefaultClient
+	// Connect to the STS stub instead of the STS endpoint of the region:
+	var dialer net.Dialer
+	http.DefaultClient = &http.Client{Transport: &http.Transport{
+		DialContext: func(
+			ctx context.Context,
+			network string,
+			addr string,
+		) (net.Conn, error) {
+			if strings.HasPrefix(addr, "sts.") {
+				addr = sts.Listener.Addr().String()
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	defer func() { http.DefaultClient = originalClient }()
+	for key, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "ID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+	} {
+		original, ok := os.LookupEnv(key)
+		os.Setenv(key, value)
+		if ok {
+			defer os.Setenv(key, original)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+	if original, ok := os.LookupEnv("AWS_REGION"); ok {
+		os.Unsetenv("AWS_REGION")
+		defer os.Setenv("AWS_REGION", original)
+	}
+	resetHelper()
+	file, err := createTmpFile(`
+awsEndpoint: ` + ses.URL + `
+awsRegion: ap-east-1
+awsMaxRetries: 0
+routes:
+  - senderDomain: example.org
+    roleArn: arn:aws:iam::123456789012:role/relay
+`)
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*configFile = *file
+	if err := configure(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	originalOut := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	err = relayClient.Send(
+		&net.TCPAddr{IP: []byte{127, 0, 0, 1}},
+		"alice@example.org",
+		[]string{"bob@example.org"},
+		[]byte("Subject: Test\r\n\r\nTEST\r\n"),
+	)
+	os.Stdout = originalOut
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if stsCalls != 1 || stsForm.Get("Action") != "AssumeRole" {
+		t.Errorf("Unexpected AssumeRole requests: %d, %v", stsCalls, stsForm)
+	}
+	if stsHost != "sts.ap-east-1.amazonaws.com" {
+		t.Errorf("Unexpected STS host: %s. Expected: %s", stsHost, "sts.ap-east-1.amazonaws.com")
+	}
+	if !strings.Contains(authorization, "Credential=AKID/") {
+		t.Errorf("Unexpected API request authorization: %s", authorization)
+	}
+}
+
 func TestConfigureWithIPs(t *testing.T) {
 	resetHelper()
 	*ips = "127.0.0.1,2001:4860:0:2001::68"
@@ -234,8 +818,39 @@ func TestConfigureWithIPs(t *testing.T) {
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err)
 	}
-	if len(ipMap) != 2 {
-		t.Errorf("Unexpected IP map size: %d", len(ipMap))
+	if len(allowNets) != 2 {
+		t.Errorf("Unexpected allowed networks size: %d", len(allowNets))
+	}
+}
+
+func TestConfigureWithCIDRs(t *testing.T) {
+	resetHelper()
+	*ips = "10.0.0.0/16,fd00::/8"
+	*denyIPs = "10.0.1.0/24"
+	err := configure()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if len(allowNets) != 2 {
+		t.Errorf("Unexpected allowed networks size: %d", len(allowNets))
+	}
+	if len(denyNets) != 1 {
+		t.Errorf("Unexpected denied networks size: %d", len(denyNets))
+	}
+}
+
+func TestConfigureWithInvalidIPs(t *testing.T) {
+	resetHelper()
+	*ips = "127.0.0.1,invalid"
+	err := configure()
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+	resetHelper()
+	*denyIPs = "10.0.0.0/33"
+	err = configure()
+	if err == nil {
+		t.Error("Unexpected nil error")
 	}
 }
 
@@ -369,14 +984,17 @@ func TestServerWithIPs(t *testing.T) {
 	}
 }
 
-func TestServerWithBcryptHash(t *testing.T) {
+func TestServerWithTrustedIPs(t *testing.T) {
 	resetHelper()
-	*user = "username"
-	os.Setenv("BCRYPT_HASH", sampleHash)
+	*trustedIPs = "192.168.0.0/24"
+	*checkIPs = true
 	err := configure()
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err)
 	}
+	if len(trustedNets) != 1 {
+		t.Errorf("Unexpected trusted networks size: %d", len(trustedNets))
+	}
 	srv, err := server()
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err)
@@ -388,58 +1006,963 @@ func TestServerWithBcryptHash(t *testing.T) {
 			true,
 		)
 	}
-	authMechs := map[string]bool{"CRAM-MD5": false}
-	if !reflect.DeepEqual(srv.AuthMechs, authMechs) {
-		t.Errorf(
-			"Unexpected AuthMechs: %v. Expected: %v",
-			srv.AuthMechs,
-			authMechs,
-		)
+	if srv.HandlerConnect == nil {
+		t.Error("Unexpected nil HandlerConnect")
+	}
+	if srv.AuthTrusted == nil {
+		t.Error("Unexpected nil AuthTrusted")
 	}
 }
 
-func TestServerWithTLS(t *testing.T) {
+func TestServerWithTrustedIPsAndAuth(t *testing.T) {
 	resetHelper()
-	var err error
-	certFile, keyFile, err = createTLSFiles("")
-	if err != nil {
-		t.Errorf("Unexpected TLS files creation error: %s", err)
-		return
+	*addr = "127.0.0.1:0"
+	*trustedIPs = "192.168.0.0/24"
+	if err := configure(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
 	}
-	defer func() {
-		os.Remove(*certFile)
-		os.Remove(*keyFile)
-	}()
-	configure()
 	srv, err := server()
 	if err != nil {
-		t.Errorf("Unexpected error: %s", err)
+		t.Fatalf("Unexpected error: %s", err)
 	}
-	if srv.TLSConfig == nil {
-		t.Errorf("Unexpected empty TLS config.")
+	ln, err := listen(srv)
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err)
+	}
+	defer ln.Close()
+	go srv.Serve(view(srv, ln))
+	originalOut := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = originalOut }()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %s", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	credentials := base64.StdEncoding.EncodeToString(
+		[]byte("anyone 00112233445566778899aabbccddeeff"),
+	)
+	var line string
+	for _, cmd := range []string{"", "HELO localhost", "AUTH CRAM-MD5", credentials} {
+		if cmd != "" {
+			fmt.Fprintf(conn, "%s\r\n", cmd)
+		}
+		if line, err = br.ReadString('\n'); err != nil {
+			t.Fatalf("Unexpected read error: %s", err)
+		}
+	}
+	if !strings.HasPrefix(line, "535 ") {
+		t.Errorf("Unexpected AUTH reply: %s. Expected: 535", line)
 	}
 }
 
-func TestServerWithTLSWithPassphrase(t *testing.T) {
+func TestConfigureWithListenerRequireAuthWithoutCredentials(t *testing.T) {
 	resetHelper()
-	passphrase := "test"
-	var err error
-	certFile, keyFile, err = createTLSFiles(passphrase)
+	file, err := createTmpFile(`
+listeners:
+  - listen: 127.0.0.1:0
+    requireAuth: true
+`)
 	if err != nil {
-		t.Errorf("Unexpected TLS files creation error: %s", err)
+		t.Errorf("Unexpected temp file creation error: %s", err)
 		return
 	}
-	defer func() {
-		os.Remove(*certFile)
-		os.Remove(*keyFile)
-	}()
-	os.Setenv("TLS_KEY_PASS", passphrase)
-	configure()
-	srv, err := server()
+	defer os.Remove(*file)
+	*configFile = *file
+	if err := configure(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+	err = ioutil.WriteFile(*file, []byte(`
+user: alice
+listeners:
+  - listen: 127.0.0.1:0
+    requireAuth: true
+`), 0600)
 	if err != nil {
+		t.Fatalf("Unexpected write error: %s", err)
+	}
+	if err := configure(); err != nil {
 		t.Errorf("Unexpected error: %s", err)
 	}
-	if srv.TLSConfig == nil {
-		t.Errorf("Unexpected empty TLS config.")
+}
+
+func TestConfigureWithInvalidTrustedIPs(t *testing.T) {
+	resetHelper()
+	*trustedIPs = "invalid"
+	err := configure()
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestServerWithBcryptHash(t *testing.T) {
+	resetHelper()
+	*user = "username"
+	os.Setenv("BCRYPT_HASH", sampleHash)
+	err := configure()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	srv, err := server()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if srv.AuthRequired != true {
+		t.Errorf(
+			"Unexpected AuthRequired: %t. Expected: %t",
+			srv.AuthRequired,
+			true,
+		)
+	}
+	authMechs := map[string]bool{"CRAM-MD5": false}
+	if !reflect.DeepEqual(srv.AuthMechs, authMechs) {
+		t.Errorf(
+			"Unexpected AuthMechs: %v. Expected: %v",
+			srv.AuthMechs,
+			authMechs,
+		)
+	}
+}
+
+func TestServerWithUsers(t *testing.T) {
+	resetHelper()
+	configure()
+	users = map[string][]byte{"alice": []byte(sampleHash)}
+	srv, err := server()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if srv.AuthRequired != true {
+		t.Errorf(
+			"Unexpected AuthRequired: %t. Expected: %t",
+			srv.AuthRequired,
+			true,
+		)
+	}
+	authMechs := map[string]bool{"CRAM-MD5": false}
+	if !reflect.DeepEqual(srv.AuthMechs, authMechs) {
+		t.Errorf(
+			"Unexpected AuthMechs: %v. Expected: %v",
+			srv.AuthMechs,
+			authMechs,
+		)
+	}
+}
+
+func TestServerWithPolicies(t *testing.T) {
+	resetHelper()
+	configure()
+	policies, _ = policy.New(nil, nil)
+	srv, err := server()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if srv.HandlerMail == nil {
+		t.Error("Unexpected nil HandlerMail")
+	}
+	if srv.HandlerRcpt == nil {
+		t.Error("Unexpected nil HandlerRcpt")
+	}
+}
+
+func TestServerWithAllowFromAndDenyTo(t *testing.T) {
+	resetHelper()
+	*allowFrom = `@example\.org$`
+	*denyTo = `^bob@`
+	configure()
+	srv, err := server()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if srv.HandlerMail == nil || srv.HandlerRcpt == nil {
+		t.Fatal("Unexpected nil HandlerMail or HandlerRcpt")
+	}
+	origin := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+	if srv.HandlerMail(origin, "alice@example.com") {
+		t.Error("Unexpected acceptance of denied sender")
+	}
+	if srv.HandlerRcpt(origin, "alice@example.org", "bob@example.org") == nil {
+		t.Error("Unexpected acceptance of denied recipient")
+	}
+	if err := srv.HandlerRcpt(origin, "alice@example.org", "carol@example.org"); err != nil {
+		t.Errorf("Unexpected recipient rejection: %s", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	resetHelper()
+	*addr = "127.0.0.1:0"
+	configure()
+	srv, err := server()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	ln, err := listen(srv)
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err)
+	}
+	defer ln.Close()
+	v := view(srv, ln)
+	if srv.Hostname == "" {
+		t.Error("Unexpected empty hostname")
+	}
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := v.Accept()
+	if err != nil {
+		t.Fatalf("Unexpected accept error: %s", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.RemoteAddr().(*session.Addr); !ok {
+		t.Errorf("Unexpected remote address type: %T", conn.RemoteAddr())
+	}
+}
+
+type mockClient struct {
+	err     error
+	sendErr error
+}
+
+func (c *mockClient) Send(
+	origin net.Addr,
+	from string,
+	to []string,
+	data []byte,
+) error {
+	return c.sendErr
+}
+
+func (c *mockClient) Check() error {
+	return c.err
+}
+
+func probeHelper(path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	admin().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func TestSender(t *testing.T) {
+	resetHelper()
+	before := metrics.Recipients.Count()
+	err := sender(&mockClient{})(&net.TCPAddr{}, "alice@example.org", []string{"bob@example.org"}, []byte("DATA"))
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if metrics.Recipients.Count() != before+1 {
+		t.Errorf("Unexpected recipients observations: %d", metrics.Recipients.Count())
+	}
+}
+
+func TestSenderWithAPIError(t *testing.T) {
+	resetHelper()
+	client := &mockClient{sendErr: awserr.New("Throttling", "Maximum sending rate exceeded.", nil)}
+	err := sender(client)(&net.TCPAddr{}, "alice@example.org", []string{"bob@example.org"}, []byte("DATA"))
+	var smtpErr smtpd.Error
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("Unexpected error: %v. Expected code: %d", err, 451)
+	}
+}
+
+func TestSenderWithPartialError(t *testing.T) {
+	resetHelper()
+	client := &mockClient{sendErr: &relay.PartialError{
+		Recipients: []string{"carol@example.org"},
+		Err:        awserr.New("Throttling", "Maximum sending rate exceeded.", nil),
+	}}
+	err := sender(client)(
+		&net.TCPAddr{},
+		"alice@example.org",
+		[]string{"bob@example.org", "carol@example.org"},
+		[]byte("DATA"),
+	)
+	var smtpErr smtpd.Error
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 554 ||
+		!strings.HasSuffix(smtpErr.Message, ": 1 recipients failed") {
+		t.Errorf("Unexpected error: %v. Expected code: %d", err, 554)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	rec := httptest.NewRecorder()
+	admin().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Unexpected status code: %d. Expected: %d", rec.Code, http.StatusOK)
+	}
+	if !strings.Contains(rec.Body.String(), "aws_smtp_relay_connections_total") {
+		t.Errorf("Unexpected metrics output: %s", rec.Body.String())
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	resetHelper()
+	rec := probeHelper("/healthz")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf(
+			"Unexpected status code: %d. Expected: %d",
+			rec.Code,
+			http.StatusServiceUnavailable,
+		)
+	}
+	atomic.StoreInt32(&serving, 1)
+	rec = probeHelper("/healthz")
+	if rec.Code != http.StatusOK {
+		t.Errorf("Unexpected status code: %d. Expected: %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	resetHelper()
+	atomic.StoreInt32(&serving, 1)
+	awsCredentials = credentials.NewStaticCredentials("id", "secret", "")
+	mock := &mockClient{err: errors.New("AccessDenied")}
+	relayClient = mock
+	rec := probeHelper("/readyz")
+	if rec.Code != http.StatusOK {
+		t.Errorf("Unexpected status code: %d. Expected: %d", rec.Code, http.StatusOK)
+	}
+	*checkAPI = true
+	rec = probeHelper("/readyz")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf(
+			"Unexpected status code: %d. Expected: %d",
+			rec.Code,
+			http.StatusServiceUnavailable,
+		)
+	}
+	mock.err = nil
+	rec = probeHelper("/readyz")
+	if rec.Code != http.StatusOK {
+		t.Errorf("Unexpected status code: %d. Expected: %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestReadyzWithInvalidCredentials(t *testing.T) {
+	resetHelper()
+	atomic.StoreInt32(&serving, 1)
+	awsCredentials = credentials.NewStaticCredentials("", "", "")
+	relayClient = &mockClient{}
+	rec := probeHelper("/readyz")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf(
+			"Unexpected status code: %d. Expected: %d",
+			rec.Code,
+			http.StatusServiceUnavailable,
+		)
+	}
+}
+
+func TestListenAdmin(t *testing.T) {
+	resetHelper()
+	err := listenAdmin()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	*adminAddr = "127.0.0.1:-1"
+	err = listenAdmin()
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+// serveHelper starts the server and opens a client session with a pending mail
+// transaction. Returns the client connection, the signal channel and a channel
+// receiving the log output of the serve function.
+func serveHelper(t *testing.T) (net.Conn, chan os.Signal, chan []byte) {
+	resetHelper()
+	*addr = "127.0.0.1:0"
+	configure()
+	relayClient = &mockClient{}
+	srv, _ := server()
+	ln, err := listen(srv)
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err)
+	}
+	signals := make(chan os.Signal, 1)
+	out := make(chan []byte, 1)
+	outReader, outWriter, _ := os.Pipe()
+	originalOut := os.Stdout
+	os.Stdout = outWriter
+	go func() {
+		err := serve([]*smtpd.Server{srv}, []*handoff.Listener{ln}, signals)
+		if err != nil {
+			t.Errorf("Unexpected serve error: %s", err)
+		}
+		os.Stdout = originalOut
+		outWriter.Close()
+		b, _ := ioutil.ReadAll(outReader)
+		out <- b
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %s", err)
+	}
+	br := bufio.NewReader(conn)
+	for _, cmd := range []string{"", "HELO localhost", "MAIL FROM:<alice@example.org>"} {
+		if cmd != "" {
+			fmt.Fprintf(conn, "%s\r\n", cmd)
+		}
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatalf("Unexpected read error: %s", err)
+		}
+	}
+	return conn, signals, out
+}
+
+func TestServe(t *testing.T) {
+	conn, signals, out := serveHelper(t)
+	defer conn.Close()
+	signals <- syscall.SIGTERM
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprintf(conn, "QUIT\r\n")
+	var entry shutdownEntry
+	if err := json.Unmarshal(<-out, &entry); err != nil {
+		t.Fatalf("Unexpected log output error: %s", err)
+	}
+	if entry.Signal != syscall.SIGTERM.String() {
+		t.Errorf("Unexpected signal: %s", entry.Signal)
+	}
+	if entry.Sessions != 1 || entry.Drained != 1 || entry.Aborted != 0 {
+		t.Errorf("Unexpected shutdown summary: %+v", entry)
+	}
+	if entry.Error != nil {
+		t.Errorf("Unexpected error: %s", *entry.Error)
+	}
+}
+
+func TestServeWithTimeout(t *testing.T) {
+	conn, signals, out := serveHelper(t)
+	defer conn.Close()
+	*drainTime = 100 * time.Millisecond
+	signals <- syscall.SIGINT
+	var entry shutdownEntry
+	if err := json.Unmarshal(<-out, &entry); err != nil {
+		t.Fatalf("Unexpected log output error: %s", err)
+	}
+	if entry.Sessions != 1 || entry.Drained != 0 || entry.Aborted != 1 {
+		t.Errorf("Unexpected shutdown summary: %+v", entry)
+	}
+	if entry.Error == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestServeWithReload(t *testing.T) {
+	conn, signals, out := serveHelper(t)
+	defer conn.Close()
+	*name = "Reloaded Relay"
+	signals <- syscall.SIGHUP
+	var banner string
+	for i := 0; i < 50 && !strings.Contains(banner, *name); i++ {
+		time.Sleep(20 * time.Millisecond)
+		newConn, err := net.Dial("tcp", conn.RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("Unexpected dial error: %s", err)
+		}
+		banner, _ = bufio.NewReader(newConn).ReadString('\n')
+		newConn.Close()
+	}
+	if !strings.Contains(banner, *name) {
+		t.Errorf("Unexpected banner after reload: %s", banner)
+	}
+	br := bufio.NewReader(conn)
+	var line string
+	for _, cmd := range []string{
+		"RCPT TO:<bob@example.org>",
+		"DATA",
+		"Subject: test\r\n\r\ntest\r\n.",
+	} {
+		fmt.Fprintf(conn, "%s\r\n", cmd)
+		var err error
+		if line, err = br.ReadString('\n'); err != nil {
+			t.Fatalf("Unexpected read error: %s", err)
+		}
+	}
+	// The previous settings relay via the mock client, which always succeeds.
+	if !strings.HasPrefix(line, "250") {
+		t.Errorf("Unexpected reply of session with previous settings: %s", line)
+	}
+	signals <- syscall.SIGTERM
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprintf(conn, "QUIT\r\n")
+	lines := strings.Split(strings.TrimSpace(string(<-out)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected log output: %s", lines)
+	}
+	var entry reloadEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Unexpected log output error: %s", err)
+	}
+	if entry.Signal != syscall.SIGHUP.String() || entry.Sessions < 1 {
+		t.Errorf("Unexpected reload summary: %+v", entry)
+	}
+	if entry.Error != nil {
+		t.Errorf("Unexpected error: %s", *entry.Error)
+	}
+}
+
+func TestReloadWithInvalidConfig(t *testing.T) {
+	resetHelper()
+	configure()
+	client := relayClient
+	*ips = "invalid"
+	srvs, err := reload(nil)
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+	if srvs != nil {
+		t.Error("Unexpected servers")
+	}
+	if relayClient != client || allowNets != nil {
+		t.Error("Unexpected change of previous settings")
+	}
+}
+
+func TestReloadWithInvalidAWSSession(t *testing.T) {
+	resetHelper()
+	configure()
+	client := relayClient
+	os.Setenv("AWS_STS_REGIONAL_ENDPOINTS", "invalid")
+	defer os.Unsetenv("AWS_STS_REGIONAL_ENDPOINTS")
+	srvs, err := reload(nil)
+	if err == nil {
+		t.Error("Unexpected nil error")
+	}
+	if srvs != nil {
+		t.Error("Unexpected servers")
+	}
+	if relayClient != client {
+		t.Error("Unexpected change of previous settings")
+	}
+}
+
+func TestReloadRestoresFlagsAndEnv(t *testing.T) {
+	resetHelper()
+	os.Setenv("PASSWORD", "secret")
+	defer os.Unsetenv("PASSWORD")
+	*user = "alice"
+	file, err := createTmpFile(`
+user: bob
+password: changed
+allowIPs: invalid
+`)
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*configFile = *file
+	if _, err := reload(nil); err == nil {
+		t.Error("Unexpected nil error")
+	}
+	if *user != "alice" || *ips != "" {
+		t.Errorf("Unexpected flags: %q, %q", *user, *ips)
+	}
+	if value := os.Getenv("PASSWORD"); value != "secret" {
+		t.Errorf("Unexpected PASSWORD: %q. Expected: %q", value, "secret")
+	}
+	if _, exists := os.LookupEnv("BCRYPT_HASH"); exists {
+		t.Error("Unexpected BCRYPT_HASH")
+	}
+}
+
+func TestConfigureWithListeners(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile(`
+policies:
+  users:
+    alice:
+      maxRecipients: 1
+listeners:
+  - listen: 127.0.0.1:0
+    onlyTLS: true
+  - listen: 127.0.0.1:0
+    startTLS: true
+    requireAuth: false
+    policies:
+      users:
+        bob:
+          maxRecipients: 2
+`)
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*configFile = *file
+	if err := configure(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("Unexpected listeners: %v", listeners)
+	}
+	if !listeners[0].onlyTLS || listeners[0].policies != policies {
+		t.Errorf("Unexpected first listener: %+v", listeners[0])
+	}
+	if !listeners[1].startTLS || listeners[1].policies == policies {
+		t.Errorf("Unexpected second listener: %+v", listeners[1])
+	}
+	*user = "alice"
+	srvs, err := servers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(srvs) != 3 {
+		t.Fatalf("Unexpected number of servers: %d. Expected: %d", len(srvs), 3)
+	}
+	if !srvs[0].AuthRequired || !srvs[1].AuthRequired || srvs[2].AuthRequired {
+		t.Error("Unexpected authentication requirements")
+	}
+	if !srvs[1].TLSListener || !srvs[2].TLSRequired {
+		t.Error("Unexpected TLS modes")
+	}
+	lns, err := listenAll(srvs)
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err)
+	}
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+func TestConfigureWithInvalidListenerPolicies(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile(`
+listeners:
+  - listen: 127.0.0.1:0
+    policies:
+      ips:
+        invalid: {}
+`)
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*configFile = *file
+	if err := configure(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestListenAllWithInvalidAddress(t *testing.T) {
+	srvs := []*smtpd.Server{{Addr: "127.0.0.1:0"}, {Addr: "127.0.0.1:-1"}}
+	if _, err := listenAll(srvs); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestReloadWithChangedListeners(t *testing.T) {
+	resetHelper()
+	configure()
+	current := []*smtpd.Server{{Addr: ":1025"}, {Addr: ":1587"}}
+	if _, err := reload(current); err == nil {
+		t.Error("Unexpected nil error for removed listener")
+	}
+	*addr = ":2525"
+	if _, err := reload(current[:1]); err == nil {
+		t.Error("Unexpected nil error for changed listen address")
+	}
+	*addr = ":1025"
+	if _, err := reload(current[:1]); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestConfigureWithClientCA(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile(certPEM)
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*clientCA = *file
+	*clientMap = "spiffe://example.org/billing=billing"
+	if err := configure(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if clientCAs == nil {
+		t.Error("Unexpected nil client CAs")
+	}
+	if certUsers["spiffe://example.org/billing"] != "billing" {
+		t.Errorf("Unexpected client certificate users: %v", certUsers)
+	}
+	*clientMap = "invalid"
+	if err := configure(); err == nil {
+		t.Error("Unexpected nil error for invalid client certificate users")
+	}
+}
+
+func TestConfigureWithInvalidClientCA(t *testing.T) {
+	resetHelper()
+	file, err := createTmpFile("invalid")
+	if err != nil {
+		t.Errorf("Unexpected temp file creation error: %s", err)
+		return
+	}
+	defer os.Remove(*file)
+	*clientCA = *file
+	if err := configure(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+	*clientCA = "/nonexistent/ca.pem"
+	if err := configure(); err == nil {
+		t.Error("Unexpected nil error")
+	}
+}
+
+func TestServerWithClientCA(t *testing.T) {
+	resetHelper()
+	var err error
+	certFile, keyFile, err = createTLSFiles("")
+	if err != nil {
+		t.Errorf("Unexpected TLS files creation error: %s", err)
+		return
+	}
+	defer func() {
+		os.Remove(*certFile)
+		os.Remove(*keyFile)
+	}()
+	*clientCA = *certFile
+	*clientReq = true
+	if err := configure(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	srv, err := server()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if srv.TLSConfig.ClientCAs == nil ||
+		srv.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Error("Unexpected TLS client authentication config")
+	}
+	if srv.AuthCertificate == nil {
+		t.Error("Unexpected nil AuthCertificate")
+	}
+	if !srv.AuthRequired {
+		t.Error("Unexpected optional authentication")
+	}
+}
+
+func TestServerWithTLS(t *testing.T) {
+	resetHelper()
+	var err error
+	certFile, keyFile, err = createTLSFiles("")
+	if err != nil {
+		t.Errorf("Unexpected TLS files creation error: %s", err)
+		return
+	}
+	defer func() {
+		os.Remove(*certFile)
+		os.Remove(*keyFile)
+	}()
+	configure()
+	srv, err := server()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if srv.TLSConfig == nil || srv.TLSConfig.GetCertificate == nil {
+		t.Errorf("Unexpected empty TLS config.")
+	}
+}
+
+func TestServerWithTLSOptions(t *testing.T) {
+	resetHelper()
+	var err error
+	certFile, keyFile, err = createTLSFiles("")
+	if err != nil {
+		t.Errorf("Unexpected TLS files creation error: %s", err)
+		return
+	}
+	defer func() {
+		os.Remove(*certFile)
+		os.Remove(*keyFile)
+	}()
+	*tlsMin = "1.2"
+	*tlsMax = "1.3"
+	*tlsCiphers = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_RSA_WITH_AES_128_CBC_SHA"
+	*tlsCurves = "X25519,P256"
+	configure()
+	srv, err := server()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	config := srv.TLSConfig
+	if config.MinVersion != tls.VersionTLS12 || config.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("Unexpected TLS versions: %x-%x", config.MinVersion, config.MaxVersion)
+	}
+	expectedCiphers := []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	}
+	if !reflect.DeepEqual(config.CipherSuites, expectedCiphers) {
+		t.Errorf("Unexpected TLS ciphers: %v", config.CipherSuites)
+	}
+	expectedCurves := []tls.CurveID{tls.X25519, tls.CurveP256}
+	if !reflect.DeepEqual(config.CurvePreferences, expectedCurves) {
+		t.Errorf("Unexpected TLS curves: %v", config.CurvePreferences)
+	}
+	if srv.HandlerTLS == nil {
+		t.Error("Unexpected nil HandlerTLS")
+	}
+}
+
+func TestServerWithInvalidTLSOptions(t *testing.T) {
+	resetHelper()
+	var err error
+	certFile, keyFile, err = createTLSFiles("")
+	if err != nil {
+		t.Errorf("Unexpected TLS files creation error: %s", err)
+		return
+	}
+	defer func() {
+		os.Remove(*certFile)
+		os.Remove(*keyFile)
+	}()
+	configure()
+	tests := []struct {
+		min, max, ciphers, curves string
+	}{
+		{"1.4", "", "", ""},
+		{"", "SSLv3", "", ""},
+		{"1.3", "1.2", "", ""},
+		{"", "", "TLS_INVALID", ""},
+		{"", "", "", "P123"},
+	}
+	for _, tt := range tests {
+		*tlsMin, *tlsMax, *tlsCiphers, *tlsCurves = tt.min, tt.max, tt.ciphers, tt.curves
+		if _, err := server(); err == nil {
+			t.Errorf("Unexpected nil error for TLS options: %+v", tt)
+		}
+	}
+}
+
+func TestServerWithTLSWithPassphrase(t *testing.T) {
+	resetHelper()
+	passphrase := "test"
+	var err error
+	certFile, keyFile, err = createTLSFiles(passphrase)
+	if err != nil {
+		t.Errorf("Unexpected TLS files creation error: %s", err)
+		return
+	}
+	defer func() {
+		os.Remove(*certFile)
+		os.Remove(*keyFile)
+	}()
+	os.Setenv("TLS_KEY_PASS", passphrase)
+	configure()
+	srv, err := server()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if srv.TLSConfig == nil || srv.TLSConfig.GetCertificate == nil {
+		t.Errorf("Unexpected empty TLS config.")
+	}
+}
+
+// sesStub returns a local HTTP server implementing the SES SendRawEmail API,
+// which stores the parameters of the last request and replies with the given
+// status code and body.
+func sesStub(status *int, body *string, form *url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			*form = r.PostForm
+			w.Header().Set("Content-Type", "text/xml")
+			w.WriteHeader(*status)
+			fmt.Fprint(w, *body)
+		},
+	))
+}
+
+func TestIntegrationWithSESStub(t *testing.T) {
+	status := http.StatusOK
+	body := `<SendRawEmailResponse>
+  <SendRawEmailResult><MessageId>1</MessageId></SendRawEmailResult>
+</SendRawEmailResponse>`
+	var form url.Values
+	api := sesStub(&status, &body, &form)
+	defer api.Close()
+	for key, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "ID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+	} {
+		original, ok := os.LookupEnv(key)
+		os.Setenv(key, value)
+		if ok {
+			defer os.Setenv(key, original)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+	resetHelper()
+	*addr = "127.0.0.1:0"
+	*endpoint = api.URL
+	*awsRegion = "us-east-1"
+	*maxRetries = 0
+	if err := configure(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	srv, err := server()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ln, err := listen(srv)
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err)
+	}
+	defer ln.Close()
+	go srv.Serve(view(srv, ln))
+	originalOut := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = originalOut }()
+	data := "Subject: Test\r\n\r\nTEST\r\n"
+	err = smtp.SendMail(
+		ln.Addr().String(),
+		nil,
+		"alice@example.org",
+		[]string{"bob@example.org"},
+		[]byte(data),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if form.Get("Action") != "SendRawEmail" ||
+		form.Get("Source") != "alice@example.org" ||
+		form.Get("Destinations.member.1") != "bob@example.org" {
+		t.Errorf("Unexpected API request: %v", form)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(form.Get("RawMessage.Data"))
+	if !strings.HasSuffix(string(raw), data) {
+		t.Errorf("Unexpected raw message: %q", raw)
+	}
+	status = http.StatusBadRequest
+	body = `<ErrorResponse>
+  <Error>
+    <Type>Sender</Type>
+    <Code>MessageRejected</Code>
+    <Message>Email address is not verified.</Message>
+  </Error>
+  <RequestId>1</RequestId>
+</ErrorResponse>`
+	err = smtp.SendMail(
+		ln.Addr().String(),
+		nil,
+		"alice@example.org",
+		[]string{"bob@example.org"},
+		[]byte(data),
+	)
+	expected := "5.6.0 Message rejected: Email address is not verified."
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 554 ||
+		protoErr.Msg != expected {
+		t.Errorf("Unexpected error: %v. Expected: 554 %s", err, expected)
 	}
 }